@@ -0,0 +1,237 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cacher
+
+import (
+	"container/list"
+	"sync"
+)
+
+// defaultContinueCacheCapacity bounds how many distinct resource versions
+// continueCache remembers as valid to page from, when newWatchCache isn't
+// given a more specific capacity by its caller (e.g. derived from a
+// cacher's configured watch cache size).
+const defaultContinueCacheCapacity = 4096
+
+// arcList names which of the four lists an entry currently lives in.
+type arcList int
+
+const (
+	arcT1 arcList = iota
+	arcT2
+	arcB1
+	arcB2
+)
+
+// arcCache is an Adaptive Replacement Cache (Nimrod Megiddo & Dharmendra
+// Modha) of uint64 keys. It tracks membership only (no values): T1/T2 are
+// the real, resident keys (recency/frequency respectively), B1/B2 are
+// "ghost" entries remembering recently evicted keys so the cache can tell
+// whether it is thrashing on recency or frequency and self-tune towards
+// whichever is winning.
+type arcCache struct {
+	lock sync.Mutex
+
+	capacity int
+	p        int // target size of T1, adapted on every ghost hit.
+
+	t1, t2, b1, b2 *list.List
+	entries        map[uint64]*list.Element
+
+	hits, misses, ghostHits uint64
+}
+
+type arcEntry struct {
+	key  uint64
+	list arcList
+}
+
+func newARCCache(capacity int) *arcCache {
+	return &arcCache{
+		capacity: capacity,
+		t1:       list.New(),
+		t2:       list.New(),
+		b1:       list.New(),
+		b2:       list.New(),
+		entries:  make(map[uint64]*list.Element),
+	}
+}
+
+// access runs the ARC state machine for key. insertOnMiss controls whether
+// a key that isn't present in any list should be admitted (used when the
+// caller is establishing a new cacheable key, as opposed to merely probing
+// whether one it remembers is still resident). It returns whether key is
+// resident (in T1 or T2) once access returns.
+func (a *arcCache) access(key uint64, insertOnMiss bool) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if elem, ok := a.entries[key]; ok {
+		entry := elem.Value.(*arcEntry)
+		switch entry.list {
+		case arcT1, arcT2:
+			a.hits++
+			a.t2.MoveToFront(elem)
+			entry.list = arcT2
+			return true
+		case arcB1:
+			a.ghostHits++
+			delta := 1
+			if a.b1.Len() > 0 && a.b2.Len() > a.b1.Len() {
+				delta = a.b2.Len() / a.b1.Len()
+			}
+			a.p = min(a.capacity, a.p+delta)
+			a.replace(false)
+			a.b1.Remove(elem)
+			delete(a.entries, key)
+			a.insertFront(a.t2, key, arcT2)
+			return true
+		case arcB2:
+			a.ghostHits++
+			delta := 1
+			if a.b2.Len() > 0 && a.b1.Len() > a.b2.Len() {
+				delta = a.b1.Len() / a.b2.Len()
+			}
+			a.p = max(0, a.p-delta)
+			a.replace(true)
+			a.b2.Remove(elem)
+			delete(a.entries, key)
+			a.insertFront(a.t2, key, arcT2)
+			return true
+		}
+	}
+
+	a.misses++
+	if !insertOnMiss {
+		return false
+	}
+
+	switch {
+	case a.t1.Len()+a.b1.Len() == a.capacity:
+		if a.t1.Len() < a.capacity {
+			a.evictLRU(a.b1)
+			a.replace(false)
+		} else {
+			a.evictLRU(a.t1)
+		}
+	case a.t1.Len()+a.t2.Len()+a.b1.Len()+a.b2.Len() >= a.capacity:
+		if a.t1.Len()+a.t2.Len()+a.b1.Len()+a.b2.Len() >= 2*a.capacity {
+			a.evictLRU(a.b2)
+		}
+		a.replace(false)
+	}
+	a.insertFront(a.t1, key, arcT1)
+	return true
+}
+
+// replace evicts the LRU entry of T1 or T2 into the matching ghost list:
+// from T1 when T1 is over its target size p, or exactly at p when the
+// triggering access was a B2 ghost hit; otherwise (or when T1 is empty)
+// from T2.
+func (a *arcCache) replace(fromB2GhostHit bool) {
+	if a.t1.Len() == 0 {
+		if a.t2.Len() > 0 {
+			a.moveLRUToGhost(a.t2, a.b2)
+		}
+		return
+	}
+	if (fromB2GhostHit && a.t1.Len() == a.p) || a.t1.Len() > a.p {
+		a.moveLRUToGhost(a.t1, a.b1)
+	} else {
+		a.moveLRUToGhost(a.t2, a.b2)
+	}
+}
+
+func (a *arcCache) moveLRUToGhost(real, ghost *list.List) {
+	elem := real.Back()
+	if elem == nil {
+		return
+	}
+	entry := elem.Value.(*arcEntry)
+	real.Remove(elem)
+	if ghost == a.b1 {
+		entry.list = arcB1
+	} else {
+		entry.list = arcB2
+	}
+	ghost.PushFront(entry)
+	a.entries[entry.key] = ghost.Front()
+	a.trimGhost(ghost)
+}
+
+// evictLRU drops the LRU entry of l (a ghost or real list) entirely,
+// releasing it for garbage collection.
+func (a *arcCache) evictLRU(l *list.List) {
+	elem := l.Back()
+	if elem == nil {
+		return
+	}
+	entry := elem.Value.(*arcEntry)
+	l.Remove(elem)
+	delete(a.entries, entry.key)
+}
+
+// trimGhost keeps the ghost lists from growing past what's needed to keep
+// |T1|+|B1| within capacity and |T1|+|T2|+|B1|+|B2| within 2x capacity,
+// matching the original ARC paper's bookkeeping bounds.
+func (a *arcCache) trimGhost(ghost *list.List) {
+	if ghost == a.b1 {
+		for a.t1.Len()+a.b1.Len() > a.capacity {
+			a.evictLRU(a.b1)
+		}
+		return
+	}
+	for a.t1.Len()+a.t2.Len()+a.b1.Len()+a.b2.Len() > 2*a.capacity {
+		a.evictLRU(a.b2)
+	}
+}
+
+func (a *arcCache) insertFront(l *list.List, key uint64, where arcList) {
+	entry := &arcEntry{key: key, list: where}
+	a.entries[key] = l.PushFront(entry)
+}
+
+// remove drops key from whichever list holds it, real or ghost.
+func (a *arcCache) remove(key uint64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	elem, ok := a.entries[key]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*arcEntry)
+	switch entry.list {
+	case arcT1:
+		a.t1.Remove(elem)
+	case arcT2:
+		a.t2.Remove(elem)
+	case arcB1:
+		a.b1.Remove(elem)
+	case arcB2:
+		a.b2.Remove(elem)
+	}
+	delete(a.entries, key)
+}
+
+// stats returns hit/miss/ghost-hit counters and the current p, for
+// exporting as metrics.
+func (a *arcCache) stats() (hits, misses, ghostHits uint64, p int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.hits, a.misses, a.ghostHits, a.p
+}
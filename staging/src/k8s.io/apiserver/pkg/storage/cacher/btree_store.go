@@ -18,34 +18,101 @@ package cacher
 
 import (
 	"fmt"
+	"math"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/btree"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/tools/cache"
 )
 
+// maxRevision is used to read a key's value as of "now": the newest
+// revision that isn't a tombstone.
+var maxRevision = revision{main: math.MaxInt64}
+
 type btreeIndexer interface {
 	cache.Store
-	ByIndex(indexName, indexValue string) ([]interface{}, error)
-	Clone() btreeIndexer
+	// ByIndex reads the index as of atRev, the same point-in-time
+	// guarantee LimitPrefixReadAt gives the unindexed walk.
+	ByIndex(indexName, indexValue string, atRev int64) ([]interface{}, error)
 	LimitPrefixRead(limit int64, key string) []interface{}
+	// LimitPrefixReadAt is like LimitPrefixRead, but reads the tree as of
+	// atRev instead of the newest revision, so that a paginated LIST can
+	// continue from a past resourceVersion without a tree clone.
+	LimitPrefixReadAt(limit int64, key string, atRev int64) []interface{}
+	// LimitByIndex is like ByIndex, but ordered by key and capable of
+	// resuming from continueKey, so a namespaced LIST ("all pods in
+	// namespace X, page 500 at a time") doesn't need a full-tree rescan
+	// per page.
+	LimitByIndex(indexName, indexValue, continueKey string, limit, atRev int64) ([]interface{}, error)
+	// LimitByIndexAndPrefix is LimitByIndex narrowed to keys sharing
+	// prefix, so a namespaced indexed LIST only walks the index entries
+	// that could possibly be in that namespace.
+	LimitByIndexAndPrefix(indexName, indexValue, prefix, continueKey string, limit, atRev int64) ([]interface{}, error)
+	// Compact drops key history strictly older than rev, bounding the
+	// memory the per-key revision histories retain.
+	Compact(rev int64)
+}
+
+// indexedKey is the item stored in a btreeStore's per-index-value btree:
+// just enough to keep keys ordered so LimitByIndex can page through them
+// without re-deriving the order from cache.Indices' unordered sets.String.
+type indexedKey struct {
+	key string
+}
+
+func (k *indexedKey) Less(than btree.Item) bool {
+	return k.key < than.(*indexedKey).key
 }
 
+var _ btree.Item = (*indexedKey)(nil)
+
 type btreeStore struct {
-	lock     sync.RWMutex
-	tree     *btree.BTree
+	lock sync.RWMutex
+	tree *btree.BTree
+	// objs holds the actual object stored at each revision a key was put
+	// at. A keyIndex's generations only record revisions; the live value
+	// is dereferenced from here.
+	objs     map[revision]*storeElement
 	indices  cache.Indices
 	indexers cache.Indexers
 	keyFunc  cache.KeyFunc
+	// degree is remembered so a newly observed (indexName, indexValue)
+	// pair can grow its own btree with the same branching factor as the
+	// main tree.
+	degree int
+	// indexTrees mirrors indices, but orders each index value's key set
+	// by key instead of holding it as an unordered sets.String, so
+	// LimitByIndex can page through it directly instead of rescanning
+	// the whole tree per key the way ByIndex historically did.
+	//
+	// Unlike indices, a key is never removed from indexTrees just because
+	// it stopped matching a value - indexMembership below only forgets it
+	// once the key's own history is fully compacted away. That keeps each
+	// value's tree a superset of every key that could still resolve to it
+	// at some atRev a caller might legally ask for; ByIndex/LimitByIndex/
+	// LimitByIndexAndPrefix narrow that superset down to the exact match
+	// by resolving each candidate at atRev and re-checking its value.
+	indexTrees map[string]map[string]*btree.BTree
+	// indexMembership records, per key, every (indexName, value) pair it
+	// has ever been inserted into indexTrees under, so that once the key's
+	// keyIndex node is finally evicted by Compact its stale entries can be
+	// found and removed without a scan of every value's tree.
+	indexMembership map[string]map[string]sets.String
 }
 
 func newBtreeStore(keyFunc cache.KeyFunc, indexers cache.Indexers, degree int) *btreeStore {
 	return &btreeStore{
-		tree:     btree.New(degree),
-		indices:  cache.Indices{},
-		indexers: indexers,
+		tree:            btree.New(degree),
+		objs:            make(map[revision]*storeElement),
+		indices:         cache.Indices{},
+		indexers:        indexers,
+		keyFunc:         keyFunc,
+		degree:          degree,
+		indexTrees:      make(map[string]map[string]*btree.BTree),
+		indexMembership: make(map[string]map[string]sets.String),
 	}
 }
 
@@ -76,17 +143,27 @@ func (t *btreeStore) Delete(obj interface{}) error {
 	if err != nil {
 		return cache.KeyError{Obj: obj, Err: err}
 	}
-	err = t.updateIndicesLocked(obj, nil, key)
-	if err != nil {
-		return err
-	}
 
-	item := t.tree.Delete(storeElem)
+	item := t.tree.Get(&keyIndex{key: key})
 	if item == nil {
 		return fmt.Errorf("obj does not exist")
 	}
+	ki := item.(*keyIndex)
+	// oldObj must stay a true nil interface{} (not a typed-nil
+	// *storeElement) when ki.modified points at a tombstone revision
+	// that Delete never wrote into t.objs - updateIndicesLocked's
+	// oldObj != nil check would otherwise see a non-nil interface and
+	// hand the indexer a nil *storeElement to dereference.
+	var oldObj interface{}
+	if existing, ok := t.objs[ki.modified]; ok {
+		oldObj = existing
+	}
 
-	return nil
+	if err := ki.tombstone(revision{main: int64(storeElem.ResourceVersion)}); err != nil {
+		return err
+	}
+
+	return t.updateIndicesLocked(oldObj, nil, key)
 }
 
 func (t *btreeStore) List() []interface{} {
@@ -95,7 +172,9 @@ func (t *btreeStore) List() []interface{} {
 
 	items := make([]interface{}, 0, t.tree.Len())
 	t.tree.Ascend(func(i btree.Item) bool {
-		items = append(items, i.(interface{}))
+		if obj, ok := t.objs[i.(*keyIndex).modified]; ok {
+			items = append(items, obj)
+		}
 		return true
 	})
 
@@ -108,7 +187,10 @@ func (t *btreeStore) ListKeys() []string {
 
 	items := make([]string, 0, t.tree.Len())
 	t.tree.Ascend(func(i btree.Item) bool {
-		items = append(items, i.(*storeElement).Key)
+		ki := i.(*keyIndex)
+		if _, ok := t.objs[ki.modified]; ok {
+			items = append(items, ki.key)
+		}
 		return true
 	})
 
@@ -123,12 +205,16 @@ func (t *btreeStore) Get(obj interface{}) (item interface{}, exists bool, err er
 	if !ok {
 		return nil, false, fmt.Errorf("obj is not a storeElement")
 	}
-	item = t.tree.Get(storeElem)
-	if item == nil {
+	i := t.tree.Get(&keyIndex{key: storeElem.Key})
+	if i == nil {
+		return nil, false, nil
+	}
+	item, ok = t.objs[i.(*keyIndex).modified]
+	if !ok {
 		return nil, false, nil
 	}
 
-	return item, false, nil
+	return item, true, nil
 }
 
 func (t *btreeStore) GetByKey(key string) (item interface{}, exists bool, err error) {
@@ -143,6 +229,7 @@ func (t *btreeStore) Replace(objs []interface{}, _ string) error {
 	defer t.lock.Unlock()
 
 	t.tree.Clear(false)
+	t.objs = make(map[revision]*storeElement, len(objs))
 	for _, obj := range objs {
 		err := t.addOrUpdateLocked(obj)
 		if err != nil {
@@ -158,13 +245,6 @@ func (t *btreeStore) Resync() error {
 	return nil
 }
 
-func (t *btreeStore) Clone() btreeIndexer {
-	t.lock.Lock()
-	defer t.lock.Unlock()
-
-	return &btreeStore{tree: t.tree.Clone()}
-}
-
 // addOrUpdateLocked assumes a lock is held and is used for Add
 // and Update operations.
 func (t *btreeStore) addOrUpdateLocked(obj interface{}) error {
@@ -178,32 +258,82 @@ func (t *btreeStore) addOrUpdateLocked(obj interface{}) error {
 		return fmt.Errorf("obj not a storeElement: %#v", obj)
 	}
 
-	returned := t.tree.ReplaceOrInsert(storeElem)
 	key, err := t.keyFunc(obj)
 	if err != nil {
 		return cache.KeyError{Obj: obj, Err: err}
 	}
-	if returned == nil {
-		return t.updateIndicesLocked(nil, obj, key)
+
+	// Reuse the existing keyIndex for this key if there is one, so that a
+	// key put again merges into the key's history instead of clobbering
+	// it. Replace clears the tree before re-adding its objects, so history
+	// from before a Replace is not kept.
+	var ki *keyIndex
+	var oldObj interface{}
+	if item := t.tree.Get(&keyIndex{key: key}); item != nil {
+		ki = item.(*keyIndex)
+		if existing, ok := t.objs[ki.modified]; ok {
+			oldObj = existing
+		}
+	} else {
+		ki = &keyIndex{key: key}
+		t.tree.ReplaceOrInsert(ki)
 	}
 
-	old := returned.(interface{})
-	return t.updateIndicesLocked(old, storeElem, key)
+	rev := revision{main: int64(storeElem.ResourceVersion)}
+	ki.put(rev)
+	t.objs[rev] = storeElem
+
+	return t.updateIndicesLocked(oldObj, obj, key)
 }
 
+// getByKeyLocked reads the key's value as of "now".
 func (t *btreeStore) getByKeyLocked(key string) (item interface{}, exists bool, err error) {
-	t.tree.Ascend(func(i btree.Item) bool {
-		if key == i.(*storeElement).Key {
-			item = i
-			exists = true
-			return false
-		}
-		return true
-	})
-
+	i := t.tree.Get(&keyIndex{key: key})
+	if i == nil {
+		return nil, false, nil
+	}
+	item, exists = t.objs[i.(*keyIndex).modified]
 	return item, exists, nil
 }
 
+// getByKeyAtLocked reads key's value as of atRev, the same point-in-time
+// resolution limitPrefixReadAt uses, so an indexed read can be narrowed
+// down from indexTrees' superset to exactly what was live at atRev.
+func (t *btreeStore) getByKeyAtLocked(key string, atRev revision) (item interface{}, exists bool) {
+	i := t.tree.Get(&keyIndex{key: key})
+	if i == nil {
+		return nil, false
+	}
+	rev, _, err := i.(*keyIndex).get(atRev)
+	if err != nil {
+		// Not live at atRev (not created yet, or deleted).
+		return nil, false
+	}
+	item, exists = t.objs[rev]
+	return item, exists
+}
+
+// matchesIndexAtLocked reports whether obj's value for indexName was
+// indexValue - re-derived from obj rather than trusted from indexTrees
+// membership, since indexTrees keeps a key around under every value it has
+// ever had so that indexMembership can find it at compaction time.
+func (t *btreeStore) matchesIndexAtLocked(indexName, indexValue string, obj interface{}) bool {
+	indexFunc := t.indexers[indexName]
+	if indexFunc == nil {
+		return false
+	}
+	values, err := indexFunc(obj)
+	if err != nil {
+		return false
+	}
+	for _, v := range values {
+		if v == indexValue {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *btreeStore) updateIndicesLocked(oldObj, newObj interface{}, key string) error {
 	var oldIndexValues, indexValues []string
 	var err error
@@ -238,26 +368,56 @@ func (t *btreeStore) updateIndicesLocked(oldObj, newObj interface{}, key string)
 		}
 
 		for _, value := range oldIndexValues {
-			t.deleteKeyFromIndexLocked(key, value, index)
+			t.deleteKeyFromIndexLocked(key, value, name, index)
 		}
 		for _, value := range indexValues {
-			t.addKeyToIndexLocked(key, value, index)
+			t.addKeyToIndexLocked(key, value, name, index)
 		}
 	}
 
 	return nil
 }
 
-func (c *btreeStore) addKeyToIndexLocked(key, value string, index cache.Index) {
+func (t *btreeStore) addKeyToIndexLocked(key, value, indexName string, index cache.Index) {
 	set := index[value]
 	if set == nil {
 		set = sets.String{}
 		index[value] = set
 	}
 	set.Insert(key)
+
+	byValue := t.indexTrees[indexName]
+	if byValue == nil {
+		byValue = make(map[string]*btree.BTree)
+		t.indexTrees[indexName] = byValue
+	}
+	valueTree := byValue[value]
+	if valueTree == nil {
+		valueTree = btree.New(t.degree)
+		byValue[value] = valueTree
+	}
+	valueTree.ReplaceOrInsert(&indexedKey{key: key})
+
+	membership := t.indexMembership[key]
+	if membership == nil {
+		membership = make(map[string]sets.String)
+		t.indexMembership[key] = membership
+	}
+	values := membership[indexName]
+	if values == nil {
+		values = sets.String{}
+		membership[indexName] = values
+	}
+	values.Insert(value)
 }
 
-func (t *btreeStore) deleteKeyFromIndexLocked(key, value string, index cache.Index) {
+// deleteKeyFromIndexLocked drops key from the "now" index set for value,
+// but deliberately leaves it in indexTrees: a paginated LIST may still need
+// to resolve key at an atRev from before the value changed, and indexTrees
+// is a superset keyed off indexMembership rather than a point-in-time
+// mirror, so it's narrowed at read time instead of write time. The stale
+// entry is reclaimed once Compact fully evicts key's keyIndex.
+func (t *btreeStore) deleteKeyFromIndexLocked(key, value, indexName string, index cache.Index) {
 	set := index[value]
 	if set == nil {
 		return
@@ -271,75 +431,327 @@ func (t *btreeStore) deleteKeyFromIndexLocked(key, value string, index cache.Ind
 	}
 }
 
+// removeKeyFromIndexTreesLocked drops key from every indexTrees entry it
+// was ever inserted into, per indexMembership. Called once key's keyIndex
+// node is itself evicted from the main tree by Compact, since only then is
+// it certain no atRev a caller could still legally ask for needs key to
+// resolve through indexTrees.
+func (t *btreeStore) removeKeyFromIndexTreesLocked(key string) {
+	membership := t.indexMembership[key]
+	if membership == nil {
+		return
+	}
+	for indexName, values := range membership {
+		byValue := t.indexTrees[indexName]
+		if byValue == nil {
+			continue
+		}
+		for value := range values {
+			valueTree := byValue[value]
+			if valueTree == nil {
+				continue
+			}
+			valueTree.Delete(&indexedKey{key: key})
+			if valueTree.Len() == 0 {
+				delete(byValue, value)
+			}
+		}
+	}
+	delete(t.indexMembership, key)
+}
+
 func (t *btreeStore) LimitPrefixRead(limit int64, key string) []interface{} {
+	return t.limitPrefixReadAt(limit, key, maxRevision)
+}
+
+func (t *btreeStore) LimitPrefixReadAt(limit int64, key string, atRev int64) []interface{} {
+	return t.limitPrefixReadAt(limit, key, revision{main: atRev})
+}
+
+func (t *btreeStore) limitPrefixReadAt(limit int64, key string, atRev revision) []interface{} {
 	t.lock.RLock()
-	defer t.lock.Unlock()
+	defer t.lock.RUnlock()
 
 	var result []interface{}
 	var elementsRetrieved int64
-	t.tree.AscendGreaterOrEqual(&storeElement{Key: key}, func(i btree.Item) bool {
-		elementKey := i.(*storeElement).Key
+	t.tree.AscendGreaterOrEqual(&keyIndex{key: key}, func(i btree.Item) bool {
+		ki := i.(*keyIndex)
 		if elementsRetrieved == limit {
 			return false
 		}
-		if !strings.HasPrefix(elementKey, key) {
+		if !strings.HasPrefix(ki.key, key) {
 			return false
 		}
+		rev, _, err := ki.get(atRev)
+		if err != nil {
+			// Not live at atRev (not created yet, or deleted): skip it
+			// without counting it against limit.
+			return true
+		}
+		obj, ok := t.objs[rev]
+		if !ok {
+			return true
+		}
 		elementsRetrieved++
-		result = append(result, i.(interface{}))
+		result = append(result, obj)
 		return true
 	})
 
 	return result
 }
 
-func (t *btreeStore) ByIndex(indexName, indexValue string) ([]interface{}, error) {
+// ByIndex returns every object whose indexName value was indexValue as of
+// atRev. indexTrees holds a superset of candidates (every key that has ever
+// had this value while still live), so each candidate is resolved at atRev
+// and re-checked against indexValue rather than trusted as-is.
+func (t *btreeStore) ByIndex(indexName, indexValue string, atRev int64) ([]interface{}, error) {
 	t.lock.RLock()
-	defer t.lock.Unlock()
+	defer t.lock.RUnlock()
 
-	indexFunc := t.indexers[indexName]
-	if indexFunc == nil {
+	if t.indexers[indexName] == nil {
 		return nil, fmt.Errorf("Index with name %s does not exist", indexName)
 	}
 
-	index := t.indices[indexName]
+	valueTree := t.indexTrees[indexName][indexValue]
+	if valueTree == nil {
+		return []interface{}{}, nil
+	}
 
-	set := index[indexValue]
-	list := make([]interface{}, 0, set.Len())
-	for key := range set {
-		obj, exists, err := t.getByKeyLocked(key)
-		if err != nil {
-			return nil, err
+	rev := revision{main: atRev}
+	list := make([]interface{}, 0, valueTree.Len())
+	valueTree.Ascend(func(i btree.Item) bool {
+		key := i.(*indexedKey).key
+		obj, exists := t.getByKeyAtLocked(key, rev)
+		if !exists || !t.matchesIndexAtLocked(indexName, indexValue, obj) {
+			return true
 		}
-		if !exists {
-			return nil, fmt.Errorf("key %s does not exist in store", key)
+		list = append(list, obj)
+		return true
+	})
+
+	return list, nil
+}
+
+// LimitByIndex walks the (indexName, indexValue) sub-tree in key order
+// starting at continueKey, so a paginated namespaced LIST can resume
+// without rescanning keys it has already returned. An empty continueKey
+// starts from the beginning of the sub-tree. Like ByIndex, each candidate
+// is resolved and re-checked at atRev rather than read as of "now".
+func (t *btreeStore) LimitByIndex(indexName, indexValue, continueKey string, limit, atRev int64) ([]interface{}, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.indexers[indexName] == nil {
+		return nil, fmt.Errorf("Index with name %s does not exist", indexName)
+	}
+
+	valueTree := t.indexTrees[indexName][indexValue]
+	if valueTree == nil {
+		return []interface{}{}, nil
+	}
+
+	rev := revision{main: atRev}
+	var list []interface{}
+	var elementsRetrieved int64
+	valueTree.AscendGreaterOrEqual(&indexedKey{key: continueKey}, func(i btree.Item) bool {
+		if elementsRetrieved == limit {
+			return false
 		}
+		key := i.(*indexedKey).key
+		obj, exists := t.getByKeyAtLocked(key, rev)
+		if !exists || !t.matchesIndexAtLocked(indexName, indexValue, obj) {
+			return true
+		}
+		elementsRetrieved++
 		list = append(list, obj)
+		return true
+	})
+
+	return list, nil
+}
+
+// LimitByIndexAndPrefix is LimitByIndex narrowed to keys sharing prefix -
+// e.g. a namespace's key range - stopping as soon as a key no longer has
+// prefix instead of walking index entries belonging to other namespaces.
+func (t *btreeStore) LimitByIndexAndPrefix(indexName, indexValue, prefix, continueKey string, limit, atRev int64) ([]interface{}, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.indexers[indexName] == nil {
+		return nil, fmt.Errorf("Index with name %s does not exist", indexName)
 	}
 
+	valueTree := t.indexTrees[indexName][indexValue]
+	if valueTree == nil {
+		return []interface{}{}, nil
+	}
+
+	start := prefix
+	if continueKey > start {
+		start = continueKey
+	}
+
+	rev := revision{main: atRev}
+	var list []interface{}
+	var elementsRetrieved int64
+	valueTree.AscendGreaterOrEqual(&indexedKey{key: start}, func(i btree.Item) bool {
+		key := i.(*indexedKey).key
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if elementsRetrieved == limit {
+			return false
+		}
+		obj, exists := t.getByKeyAtLocked(key, rev)
+		if !exists || !t.matchesIndexAtLocked(indexName, indexValue, obj) {
+			return true
+		}
+		elementsRetrieved++
+		list = append(list, obj)
+		return true
+	})
+
 	return list, nil
 }
 
+// Compact drops per-key history strictly older than rev from the tree,
+// keeping memory bounded as the watch cache's sliding window advances.
+//
+// Revisions are globally unique across every key (they're assigned from
+// the single watch cache's resourceVersion stream), so a revision
+// ki.compact drops from one key's history can never still be referenced
+// by another key's - objs entries for it can be deleted directly off
+// ki.compact's return value instead of rescanning every other key's
+// history to check, which is what made this O(N) to O(N·M) per call
+// before: this path runs on essentially every processed event once the
+// watch cache's ring buffer is full.
+func (t *btreeStore) Compact(rev int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	atRev := revision{main: rev}
+	var dead []*keyIndex
+	t.tree.Ascend(func(i btree.Item) bool {
+		ki := i.(*keyIndex)
+		for _, r := range ki.compact(atRev) {
+			delete(t.objs, r)
+		}
+		if len(ki.generations) == 1 && ki.generations[0].isEmpty() {
+			// Tombstoned and compacted with nothing older left to serve:
+			// the key can never resolve again at or after atRev, so drop
+			// its keyIndex node entirely instead of leaking it forever.
+			dead = append(dead, ki)
+		}
+		return true
+	})
+	for _, ki := range dead {
+		t.tree.Delete(ki)
+		t.removeKeyFromIndexTreesLocked(ki.key)
+	}
+}
+
 var _ btreeIndexer = (*btreeStore)(nil)
 
-// continueCache caches roots of trees that were created as
-// clones to serve LIST requests. When a continue request is
-// meant to be served for a certain LIST request, we retreive
-// the tree that served the LIST request and serve the continue
-// request from there.
+// continueCache tracks which resource versions a LIST without a
+// continuation has been served at, so that a follow-up continuation
+// request can be validated without needing to keep a snapshot of the tree
+// around: history for that RV is retained in-place in the btreeStore
+// until it is compacted out by the watch cache's sliding window.
 //
-// A tree is removed from this cache when the RV at which it was
-// created is removed from the watchCache.
+// The set of remembered RVs is bounded by an ARC rather than a plain map:
+// a burst of large LIST requests whose continue tokens are then abandoned
+// would otherwise grow this map without bound. Losing an entry to
+// eviction is safe: while the RV is still remembered in one of the ARC's
+// ghost lists, the next continuation for it re-admits it (its history is
+// only compacted after cleanup has removed it from every list); once it has
+// dropped out of the ghost lists too, the next continuation gets a 410 Gone
+// and the client relists, the same outcome as if the RV had aged out of
+// the watch cache for real.
 type continueCache struct {
-	cache map[uint64]btreeIndexer
+	arc *arcCache
+
+	pinLock sync.Mutex
+	pinned  map[uint64]int
+
+	goneCount atomic.Uint64
+}
+
+// newContinueCache builds a continueCache whose ARC holds up to capacity
+// distinct resource versions. capacity <= 0 falls back to
+// defaultContinueCacheCapacity.
+func newContinueCache(capacity int) *continueCache {
+	if capacity <= 0 {
+		capacity = defaultContinueCacheCapacity
+	}
+	return &continueCache{
+		arc:    newARCCache(capacity),
+		pinned: make(map[uint64]int),
+	}
 }
 
-func newContinueCache() *continueCache {
-	return &continueCache{cache: make(map[uint64]btreeIndexer)}
+// markValid records that rv may be used to serve continuation requests.
+func (c *continueCache) markValid(rv uint64) {
+	c.arc.access(rv, true)
+}
+
+// isValid reports whether rv may still be used to serve continuation
+// requests. A pinned rv is always reported valid regardless of the ARC's
+// own eviction decisions: pin guarantees updateCache has deferred
+// compacting rv's history, so the data a continuation would read is still
+// there even if the ARC's bounded validity tracking evicted the entry to
+// make room for other RVs. Without this check, a paginated LIST that's
+// mid-pagination on rv (pinned, but unpinned between pages while the
+// client fetches the next one) could have rv evicted from the ARC by
+// unrelated traffic and then get a spurious 410 Gone on its next page,
+// even though the data it's reading was never actually compacted away.
+func (c *continueCache) isValid(rv uint64) bool {
+	if c.isPinned(rv) {
+		return true
+	}
+	valid := c.arc.access(rv, false)
+	if !valid {
+		c.goneCount.Add(1)
+	}
+	return valid
 }
 
 func (c *continueCache) cleanup(rv uint64) {
-	if _, ok := c.cache[rv]; ok {
-		delete(c.cache, rv)
+	c.arc.remove(rv)
+}
+
+// pin marks rv as being read by an in-flight paginated LIST, so that
+// isPinned(rv) reports true until a matching unpin is called. Multiple
+// concurrent pages of the same or overlapping LISTs at the same rv are
+// tracked with a refcount rather than a boolean.
+func (c *continueCache) pin(rv uint64) {
+	c.pinLock.Lock()
+	defer c.pinLock.Unlock()
+	c.pinned[rv]++
+}
+
+// unpin releases a pin previously taken by pin(rv).
+func (c *continueCache) unpin(rv uint64) {
+	c.pinLock.Lock()
+	defer c.pinLock.Unlock()
+	if c.pinned[rv] <= 1 {
+		delete(c.pinned, rv)
+		return
 	}
+	c.pinned[rv]--
+}
+
+// isPinned reports whether rv currently has an in-flight paginated LIST
+// reading from it, so that updateCache can defer compacting its history
+// rather than racing that read.
+func (c *continueCache) isPinned(rv uint64) bool {
+	c.pinLock.Lock()
+	defer c.pinLock.Unlock()
+	return c.pinned[rv] > 0
+}
+
+// goneRate returns the running count of isValid checks that failed because
+// the rv was no longer resident in the ARC, for exporting as a 410-Gone rate
+// metric.
+func (c *continueCache) goneRate() uint64 {
+	return c.goneCount.Load()
 }
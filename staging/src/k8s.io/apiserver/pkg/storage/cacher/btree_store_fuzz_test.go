@@ -0,0 +1,366 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cacher
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fuzzReferenceStore is a minimal, obviously-correct stand-in for
+// client-go's tools/cache threadSafeMap: that type is unexported, so it
+// can't be imported directly as the oracle the request asked for. It
+// recomputes indices by brute-force scan on every query instead of
+// maintaining them incrementally, which keeps it trivially correct and
+// gives the fuzzed btreeStore something to be checked against.
+type fuzzReferenceStore struct {
+	objs map[string]*storeElement
+}
+
+func newFuzzReferenceStore() *fuzzReferenceStore {
+	return &fuzzReferenceStore{objs: make(map[string]*storeElement)}
+}
+
+func (r *fuzzReferenceStore) add(obj *storeElement) { r.objs[obj.Key] = obj }
+func (r *fuzzReferenceStore) delete(key string)     { delete(r.objs, key) }
+
+func (r *fuzzReferenceStore) list() []*storeElement {
+	out := make([]*storeElement, 0, len(r.objs))
+	for _, obj := range r.objs {
+		out = append(out, obj)
+	}
+	return out
+}
+
+func (r *fuzzReferenceStore) byIndex(indexFunc cache.IndexFunc, indexValue string) []*storeElement {
+	var out []*storeElement
+	for _, obj := range r.objs {
+		values, err := indexFunc(obj)
+		if err != nil {
+			continue
+		}
+		for _, v := range values {
+			if v == indexValue {
+				out = append(out, obj)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// fuzzGroupIndexers are registered on both the fuzzed btreeStore and used
+// directly against fuzzReferenceStore, so the two are checked against the
+// exact same notion of "what does this object index to". "owners" returns
+// two values per object to exercise the multi-value path; the erroring
+// indexer path is covered separately in TestBtreeStoreIndexerError instead
+// of here, since map iteration order makes which indices observe a given
+// Add/Update before an error aborts the rest of updateIndicesLocked
+// non-deterministic, which would make a cross-check against a from-scratch
+// reference scan flaky rather than catching a real bug.
+func fuzzGroupIndexers() cache.Indexers {
+	return cache.Indexers{
+		"group": func(obj interface{}) ([]string, error) {
+			return []string{obj.(*storeElement).Labels.Get("group")}, nil
+		},
+		"owners": func(obj interface{}) ([]string, error) {
+			group := obj.(*storeElement).Labels.Get("group")
+			return []string{"owner-" + group, "team-" + group}, nil
+		},
+	}
+}
+
+const (
+	fuzzKeyCount   = 12
+	fuzzGroupCount = 4
+)
+
+func fuzzKey(n byte) string {
+	return fmt.Sprintf("/ns/shared-%d", int(n)%fuzzKeyCount)
+}
+
+func fuzzGroupValue(n byte) string {
+	return fmt.Sprintf("group-%d", int(n)%fuzzGroupCount)
+}
+
+func newFuzzElement(key string, group byte, rv uint64) *storeElement {
+	return &storeElement{
+		Key:             key,
+		Labels:          labels.Set{"group": fuzzGroupValue(group)},
+		ResourceVersion: rv,
+	}
+}
+
+// fuzzOp is one decoded step of a fuzzed operation sequence.
+type fuzzOp struct {
+	kind  byte
+	key   byte
+	group byte
+}
+
+const (
+	fuzzOpAdd byte = iota
+	fuzzOpUpdate
+	fuzzOpDelete
+	fuzzOpGet
+	fuzzOpGetByKey
+	fuzzOpList
+	fuzzOpListKeys
+	fuzzOpByIndex
+	fuzzOpLimitPrefixRead
+	fuzzOpResync
+	fuzzOpReplace
+	fuzzOpCompact
+	numFuzzOps
+)
+
+// decodeFuzzOps turns the raw fuzz input into a bounded sequence of ops.
+// Keys all share the "/ns/shared-" prefix and there are few enough of them
+// that ops collide on the same keys, which is what exercises
+// LimitPrefixRead's prefix/limit boundaries and repeated Add/Update/Delete
+// of the same key rather than fanning out across a huge keyspace.
+func decodeFuzzOps(data []byte) []fuzzOp {
+	var ops []fuzzOp
+	for i := 0; i+2 < len(data); i += 3 {
+		ops = append(ops, fuzzOp{
+			kind:  data[i] % numFuzzOps,
+			key:   data[i+1],
+			group: data[i+2],
+		})
+	}
+	return ops
+}
+
+// applyFuzzOp runs op against store only, ignoring results and errors. It
+// is used for the concurrency phase below, where many goroutines hammer a
+// single btreeStore at once: there's nothing to assert about the result of
+// any one op under concurrent, racing access, only that none of it trips
+// the race detector or deadlocks - which is what the lock-handling bugs
+// this request exists to catch would do.
+func applyFuzzOp(store *btreeStore, op fuzzOp, nextRV func() uint64) {
+	key := fuzzKey(op.key)
+	switch op.kind {
+	case fuzzOpAdd:
+		_ = store.Add(newFuzzElement(key, op.group, nextRV()))
+	case fuzzOpUpdate:
+		_ = store.Update(newFuzzElement(key, op.group, nextRV()))
+	case fuzzOpDelete:
+		_ = store.Delete(newFuzzElement(key, op.group, nextRV()))
+	case fuzzOpGet:
+		_, _, _ = store.Get(&storeElement{Key: key})
+	case fuzzOpGetByKey:
+		_, _, _ = store.GetByKey(key)
+	case fuzzOpList:
+		_ = store.List()
+	case fuzzOpListKeys:
+		_ = store.ListKeys()
+	case fuzzOpByIndex:
+		_, _ = store.ByIndex("group", fuzzGroupValue(op.group), maxRevision.main)
+	case fuzzOpLimitPrefixRead:
+		_ = store.LimitPrefixRead(int64(op.group%5+1), "/ns/")
+	case fuzzOpResync:
+		_ = store.Resync()
+	case fuzzOpReplace:
+		_ = store.Replace([]interface{}{newFuzzElement(key, op.group, nextRV())}, "")
+	case fuzzOpCompact:
+		store.Compact(int64(nextRV()))
+	}
+}
+
+// FuzzBtreeStore drives a random sequence of Add/Update/Delete/Get/
+// GetByKey/List/ListKeys/ByIndex/LimitPrefixRead/Resync/Replace/Compact
+// calls against a btreeStore twice: once concurrently across several
+// goroutines sharing a single store, to surface lock-handling bugs under
+// -race; and once serially against a fresh store mirrored into a
+// fuzzReferenceStore, to surface correctness bugs by checking the two
+// agree after every step.
+func FuzzBtreeStore(f *testing.F) {
+	f.Add([]byte{0, 1, 1, 1, 2, 2, 2, 3, 3, 3, 1, 1, 2, 5, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ops := decodeFuzzOps(data)
+		if len(ops) == 0 {
+			return
+		}
+
+		indexers := fuzzGroupIndexers()
+
+		concurrentStore := newBtreeStore(storeElementKey, indexers, 2)
+		var rv uint64
+		var rvMu sync.Mutex
+		nextRV := func() uint64 {
+			rvMu.Lock()
+			defer rvMu.Unlock()
+			rv++
+			return rv
+		}
+
+		const workers = 4
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			w := w
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := w; i < len(ops); i += workers {
+					applyFuzzOp(concurrentStore, ops[i], nextRV)
+				}
+			}()
+		}
+		wg.Wait()
+
+		store := newBtreeStore(storeElementKey, indexers, 2)
+		reference := newFuzzReferenceStore()
+		var serialRVCounter uint64
+		nextSerialRV := func() uint64 {
+			serialRVCounter++
+			return serialRVCounter
+		}
+		for _, op := range ops {
+			key := fuzzKey(op.key)
+			switch op.kind {
+			case fuzzOpAdd, fuzzOpUpdate:
+				elem := newFuzzElement(key, op.group, nextSerialRV())
+				if op.kind == fuzzOpAdd {
+					_ = store.Add(elem)
+				} else {
+					_ = store.Update(elem)
+				}
+				reference.add(elem)
+			case fuzzOpDelete:
+				elem := newFuzzElement(key, op.group, nextSerialRV())
+				_ = store.Delete(elem)
+				reference.delete(key)
+			case fuzzOpReplace:
+				// Re-list every currently-live object under a fresh
+				// resourceVersion, the same way a real relist hands
+				// Replace the current world as it sees it now. Replace
+				// rebuilds the tree from scratch on each call, so every
+				// object is re-added as a brand-new key with no prior
+				// history.
+				replaced := make([]interface{}, 0, len(reference.objs))
+				for k, elem := range reference.objs {
+					newElem := &storeElement{Key: k, Labels: elem.Labels, ResourceVersion: nextSerialRV()}
+					replaced = append(replaced, newElem)
+					reference.objs[k] = newElem
+				}
+				_ = store.Replace(replaced, "")
+			case fuzzOpCompact:
+				// Compacting up to the newest revision observed so far
+				// must never disturb what's currently resolvable: every
+				// live object's current revision is always the newest
+				// (or only) revision of its key, so it survives
+				// compaction at any rev by construction.
+				store.Compact(int64(serialRVCounter))
+			default:
+				applyFuzzOp(store, op, nextSerialRV)
+			}
+
+			assertStoresAgree(t, store, reference, indexers)
+		}
+	})
+}
+
+// assertStoresAgree checks store and reference agree on total size, on
+// per-key existence, and on ByIndex membership for every group value in
+// play, and that no index value set has been left empty in store.indices -
+// the same leak deleteKeyFromIndexLocked's empty-set cleanup guards against
+// (see kubernetes/kubernetes#84959).
+func assertStoresAgree(t *testing.T, store *btreeStore, reference *fuzzReferenceStore, indexers cache.Indexers) {
+	t.Helper()
+
+	gotList := store.List()
+	wantList := reference.list()
+	if len(gotList) != len(wantList) {
+		t.Fatalf("btreeStore has %d live objects, reference has %d", len(gotList), len(wantList))
+	}
+
+	for _, want := range wantList {
+		item, exists, err := store.GetByKey(want.Key)
+		if err != nil {
+			t.Fatalf("GetByKey(%q): %v", want.Key, err)
+		}
+		if !exists {
+			t.Fatalf("GetByKey(%q): not found, reference has it", want.Key)
+		}
+		if got := item.(*storeElement).ResourceVersion; got != want.ResourceVersion {
+			t.Fatalf("GetByKey(%q): resourceVersion %d, reference has %d", want.Key, got, want.ResourceVersion)
+		}
+	}
+
+	groupIndexFunc := indexers["group"]
+	for g := byte(0); g < fuzzGroupCount; g++ {
+		value := fuzzGroupValue(g)
+		got, err := store.ByIndex("group", value, maxRevision.main)
+		if err != nil {
+			t.Fatalf("ByIndex(group, %q): %v", value, err)
+		}
+		want := reference.byIndex(groupIndexFunc, value)
+		if len(got) != len(want) {
+			t.Fatalf("ByIndex(group, %q): got %d objects, reference has %d", value, len(got), len(want))
+		}
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	for indexName, index := range store.indices {
+		for value, set := range index {
+			if len(set) == 0 {
+				t.Fatalf("index %q retains an empty set for value %q", indexName, value)
+			}
+		}
+	}
+}
+
+// TestBtreeStoreIndexerError checks that an indexer which errors for a
+// given object causes Add to return an error, without otherwise corrupting
+// the store: the object itself is still stored (addOrUpdateLocked writes
+// the keyIndex and objs entry before updateIndicesLocked ever runs), it's
+// just not reachable through the failing index.
+func TestBtreeStoreIndexerError(t *testing.T) {
+	erroring := cache.Indexers{
+		"erroring": func(obj interface{}) ([]string, error) {
+			elem := obj.(*storeElement)
+			if elem.Labels.Get("group") == "bad" {
+				return nil, fmt.Errorf("induced error for %s", elem.Key)
+			}
+			return []string{elem.Labels.Get("group")}, nil
+		},
+	}
+	store := newBtreeStore(storeElementKey, erroring, 2)
+
+	elem := &storeElement{Key: "/ns/bad-obj", Labels: labels.Set{"group": "bad"}, ResourceVersion: 1}
+	if err := store.Add(elem); err == nil {
+		t.Fatalf("Add with an erroring indexer: got nil error, want non-nil")
+	}
+
+	item, exists, err := store.GetByKey("/ns/bad-obj")
+	if err != nil || !exists {
+		t.Fatalf("GetByKey(%q) after failed index update: exists=%v err=%v, want exists=true err=nil", elem.Key, exists, err)
+	}
+	if item.(*storeElement).Key != elem.Key {
+		t.Fatalf("GetByKey(%q) returned %#v", elem.Key, item)
+	}
+
+	if got, err := store.ByIndex("erroring", "bad", maxRevision.main); err != nil || len(got) != 0 {
+		t.Fatalf("ByIndex(erroring, bad) = %v, %v; want empty, nil since the indexer never succeeded for this value", got, err)
+	}
+}
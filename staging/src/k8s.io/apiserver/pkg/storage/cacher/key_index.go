@@ -0,0 +1,214 @@
+/*
+Copyright 2022 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cacher
+
+import (
+	"fmt"
+
+	"github.com/google/btree"
+)
+
+// revision identifies a single modification stored in a keyIndex, the same
+// way etcd's mvcc package identifies a modification of a key. main is the
+// resourceVersion the modification happened at; sub disambiguates multiple
+// modifications observed at the same resourceVersion and is currently
+// always 0 since the watch cache only ever sees one event per RV.
+type revision struct {
+	main int64
+	sub  int64
+}
+
+// GreaterThan reports whether a is a later revision than b.
+func (a revision) GreaterThan(b revision) bool {
+	if a.main != b.main {
+		return a.main > b.main
+	}
+	return a.sub > b.sub
+}
+
+// generation groups together the revisions written between a key coming
+// into existence (or being re-created after a delete) and its next
+// tombstone. keyIndex.tombstone closes a generation by appending an empty
+// one behind it, so only the last generation can be empty, and an empty
+// last generation marks that the key is currently deleted.
+type generation struct {
+	// created is the revision at which this generation came into being.
+	created revision
+	// modified is the most recent revision written to this generation.
+	modified revision
+	revs     []revision
+}
+
+func (g *generation) isEmpty() bool {
+	return g == nil || len(g.revs) == 0
+}
+
+// keyIndex is the per-key revision history kept in the btree in place of a
+// single storeElement, mirroring etcd's mvcc.keyIndex. It lets Get(key,
+// atRev) answer "what did this key look like at resourceVersion atRev"
+// with a plain walk of its generations instead of reconstructing the tree
+// as it existed at that revision.
+type keyIndex struct {
+	key         string
+	modified    revision
+	generations []generation
+}
+
+func (ki *keyIndex) Less(than btree.Item) bool {
+	return ki.key < than.(*keyIndex).key
+}
+
+var _ btree.Item = (*keyIndex)(nil)
+
+// isEmpty reports whether the key has never been put.
+func (ki *keyIndex) isEmpty() bool {
+	return len(ki.generations) == 0
+}
+
+// currentGeneration returns the generation currently accepting puts, or
+// nil if the key has never been put.
+func (ki *keyIndex) currentGeneration() *generation {
+	if len(ki.generations) == 0 {
+		return nil
+	}
+	return &ki.generations[len(ki.generations)-1]
+}
+
+// put appends rev to the key's current generation, opening the first
+// generation if this is the first time the key is put. put also merges
+// correctly into a keyIndex that is being replayed from a restore rather
+// than clobbering its existing history.
+func (ki *keyIndex) put(rev revision) {
+	if ki.isEmpty() {
+		ki.generations = append(ki.generations, generation{})
+	}
+	g := ki.currentGeneration()
+	if g.isEmpty() {
+		g.created = rev
+	}
+	g.revs = append(g.revs, rev)
+	g.modified = rev
+	ki.modified = rev
+}
+
+// tombstone closes the current generation at rev, so that the key reads
+// as deleted for any atRev >= rev until it is put again.
+func (ki *keyIndex) tombstone(rev revision) error {
+	if ki.isEmpty() {
+		return fmt.Errorf("cannot tombstone key %q: never put", ki.key)
+	}
+	if ki.currentGeneration().isEmpty() {
+		return fmt.Errorf("cannot tombstone key %q: already deleted", ki.key)
+	}
+	ki.put(rev)
+	ki.generations = append(ki.generations, generation{})
+	return nil
+}
+
+// get returns the newest revision of ki that is not after atRev, and the
+// revision at which the generation containing it was created. It returns
+// an error both when the key didn't exist yet at atRev and when the key
+// was deleted (tombstoned) at or before atRev - including a key that was
+// deleted and later re-created, which is resolved to whichever generation
+// was alive at atRev.
+func (ki *keyIndex) get(atRev revision) (modified, created revision, err error) {
+	if ki.isEmpty() {
+		return revision{}, revision{}, fmt.Errorf("key %q has no history", ki.key)
+	}
+	lastGen := len(ki.generations) - 1
+	for i := lastGen; i >= 0; i-- {
+		g := &ki.generations[i]
+		if g.isEmpty() {
+			// An empty generation is the placeholder tombstone() leaves
+			// behind as the last generation when it closes the previous
+			// one; skip over it to keep walking back.
+			continue
+		}
+		if g.created.GreaterThan(atRev) {
+			// This generation didn't exist yet at atRev; an older one
+			// (if any) might.
+			continue
+		}
+		closed := i != lastGen
+		for j := len(g.revs) - 1; j >= 0; j-- {
+			rev := g.revs[j]
+			if rev.GreaterThan(atRev) {
+				continue
+			}
+			if closed && j == len(g.revs)-1 {
+				// rev is the revision that tombstoned this generation:
+				// the key is deleted as of atRev.
+				return revision{}, revision{}, fmt.Errorf("key %q was deleted at or before %v", ki.key, atRev)
+			}
+			return rev, g.created, nil
+		}
+		return revision{}, revision{}, fmt.Errorf("key %q has no revision at or before %v", ki.key, atRev)
+	}
+	return revision{}, revision{}, fmt.Errorf("key %q did not exist at %v", ki.key, atRev)
+}
+
+// compact drops history strictly older than atRev, keeping just enough of
+// each generation for get(rev) to still resolve for any rev >= atRev:
+// closed generations that were already tombstoned at or before atRev are
+// dropped entirely, and within a remaining generation every revision
+// older than the newest one <= atRev is dropped. It returns every
+// revision it dropped, so the caller can evict exactly those entries from
+// its revision->object map instead of rescanning the whole tree to find
+// out which revisions are still referenced.
+func (ki *keyIndex) compact(atRev revision) (dropped []revision) {
+	lastGen := len(ki.generations) - 1
+	kept := ki.generations[:0]
+	for i, g := range ki.generations {
+		if g.isEmpty() {
+			if i == lastGen {
+				kept = append(kept, g)
+			}
+			continue
+		}
+		if i != lastGen && !g.modified.GreaterThan(atRev) {
+			// Fully tombstoned at or before the compaction point: no
+			// query at atRev or later can ever observe it again.
+			dropped = append(dropped, g.revs...)
+			continue
+		}
+		base := -1
+		for j, rev := range g.revs {
+			if rev.GreaterThan(atRev) {
+				base = j
+				break
+			}
+		}
+		switch {
+		case base == -1:
+			// Every revision is <= atRev: keep only the newest as the
+			// live baseline for future Get(rev) calls.
+			dropped = append(dropped, g.revs[:len(g.revs)-1]...)
+			g.revs = g.revs[len(g.revs)-1:]
+		case base == 0:
+			// Nothing to drop.
+		default:
+			dropped = append(dropped, g.revs[:base-1]...)
+			newRevs := make([]revision, 0, len(g.revs)-base+1)
+			newRevs = append(newRevs, g.revs[base-1])
+			newRevs = append(newRevs, g.revs[base:]...)
+			g.revs = newRevs
+		}
+		kept = append(kept, g)
+	}
+	ki.generations = kept
+	return dropped
+}
@@ -17,22 +17,26 @@ limitations under the License.
 package cacher
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"path"
 	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/btree"
-	"k8s.io/apimachinery/pkg/api/errors"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/apiserver/pkg/storage"
 	"k8s.io/client-go/tools/cache"
@@ -64,6 +68,23 @@ const (
 
 	// defaultUpperBoundCapacity  should be able to keep eventFreshDuration of history.
 	defaultUpperBoundCapacity = 100 * 1024
+
+	// compactionReaperInterval is how often the reaper retries deferred
+	// compactions left behind by a still-in-flight paginated LIST.
+	compactionReaperInterval = 5 * time.Second
+
+	// maxDeferredCompactionAge bounds how long a compaction can be held
+	// back for a pinned resource version before the reaper forces it
+	// through anyway, trading consistency of that one (presumably stuck
+	// or abandoned) LIST for bounded memory growth.
+	maxDeferredCompactionAge = 2 * time.Minute
+
+	// defaultProgressNotifyInterval is how often, absent any real writes,
+	// watchCache sends a synthetic bookmark carrying its current
+	// resourceVersion. Without this, a watcher on an idle namespace has
+	// no way to learn that resourceVersion has advanced elsewhere and
+	// can stall waiting for an event that will never come.
+	defaultProgressNotifyInterval = 5 * time.Minute
 )
 
 // watchCacheEvent is a single "watch event" that is send to users of
@@ -93,14 +114,12 @@ type storeElement struct {
 	Object runtime.Object
 	Labels labels.Set
 	Fields fields.Set
+	// ResourceVersion is the revision this value of the object was
+	// written at. It is what the underlying btreeStore's keyIndex uses
+	// to serve Get/List as of a past resourceVersion.
+	ResourceVersion uint64
 }
 
-func (t *storeElement) Less(than btree.Item) bool {
-	return t.Key < than.(*storeElement).Key
-}
-
-var _ btree.Item = (*storeElement)(nil)
-
 func storeElementKey(obj interface{}) (string, error) {
 	elem, ok := obj.(*storeElement)
 	if !ok {
@@ -193,8 +212,9 @@ type watchCache struct {
 	// and additionally gets the previous value of the object.
 	eventHandler func(*watchCacheEvent)
 
-	// for testing timeouts.
-	clock clock.Clock
+	// for testing timeouts. WithTicker (rather than plain Clock) because
+	// runCompactionReaper and runProgressNotify both need NewTicker.
+	clock clock.WithTicker
 
 	// An underlying storage.Versioner.
 	versioner storage.Versioner
@@ -206,6 +226,52 @@ type watchCache struct {
 	indexValidator indexValidator
 
 	continueCache *continueCache
+
+	// indexers mirrors the indexers the store was built with, so
+	// WaitUntilFreshAndList can tell whether a predicate names one it can
+	// serve a LIST from directly.
+	indexers cache.Indexers
+
+	// indexUsage counts how often WaitUntilFreshAndList could (hit) or
+	// couldn't (miss) serve a LIST from an indexed posting list instead
+	// of a full prefix walk.
+	indexUsage indexUsageStats
+
+	// pendingCompactions holds oldest-RV compactions that updateCache
+	// had to defer because a paginated LIST was still reading that
+	// revision's history. The reaper goroutine retries them.
+	pendingCompactionsLock sync.Mutex
+	pendingCompactions     []pendingCompaction
+
+	// progressNotifyInterval is how often runProgressNotify sends a
+	// synthetic bookmark when no other bookmark has gone out within the
+	// interval. 0 disables the periodic heartbeat entirely.
+	progressNotifyInterval time.Duration
+
+	// bookmarkLock guards lastBookmark, which is shared between
+	// UpdateResourceVersion, RequestWatchProgress, and the periodic
+	// progress-notify heartbeat so the heartbeat can skip a tick that a
+	// real bookmark already covered. Add/Update/Delete events processed
+	// by processEvent do not update it.
+	bookmarkLock sync.Mutex
+	lastBookmark time.Time
+
+	// stopCh is closed by Stop to terminate runCompactionReaper and
+	// runProgressNotify. Without it, every watchCache this package
+	// constructs - including the churn of per-resource caches that get
+	// created and torn down - would leak both goroutines for the
+	// lifetime of the process.
+	stopCh chan struct{}
+	// stopOnce makes Stop idempotent: closing stopCh twice panics.
+	stopOnce sync.Once
+}
+
+// pendingCompaction is a compaction updateCache deferred because
+// continueCache reported the revision as still pinned by an in-flight
+// paginated LIST.
+type pendingCompaction struct {
+	rv    uint64
+	since time.Time
 }
 
 func newWatchCache(
@@ -214,8 +280,10 @@ func newWatchCache(
 	getAttrsFunc func(runtime.Object) (labels.Set, fields.Set, error),
 	versioner storage.Versioner,
 	indexers *cache.Indexers,
-	clock clock.Clock,
+	clock clock.WithTicker,
+	continueCacheCapacity int,
 	objectType reflect.Type) *watchCache {
+	storeIndexers := storeElementIndexers(indexers)
 	wc := &watchCache{
 		capacity:           defaultLowerBoundCapacity,
 		keyFunc:            keyFunc,
@@ -226,23 +294,92 @@ func newWatchCache(
 		startIndex:         0,
 		endIndex:           0,
 		// store:               cache.NewIndexer(storeElementKey, storeElementIndexers(indexers)),
-		store:               newBtreeStore(2), // TODO: figure out what the degree should be.
-		resourceVersion:     0,
-		listResourceVersion: 0,
-		eventHandler:        eventHandler,
-		clock:               clock,
-		versioner:           versioner,
-		objectType:          objectType,
-		continueCache:       newContinueCache(),
+		store:                  newBtreeStore(storeElementKey, storeIndexers, 2), // TODO: figure out what the degree should be.
+		resourceVersion:        0,
+		listResourceVersion:    0,
+		eventHandler:           eventHandler,
+		clock:                  clock,
+		versioner:              versioner,
+		objectType:             objectType,
+		continueCache:          newContinueCache(continueCacheCapacity),
+		indexers:               storeIndexers,
+		progressNotifyInterval: defaultProgressNotifyInterval,
+		stopCh:                 make(chan struct{}),
 	}
 	objType := objectType.String()
 	watchCacheCapacity.WithLabelValues(objType).Set(float64(wc.capacity))
 	wc.cond = sync.NewCond(wc.RLocker())
 	wc.indexValidator = wc.isIndexValidLocked
 
+	go wc.runCompactionReaper()
+	if wc.progressNotifyInterval > 0 {
+		go wc.runProgressNotify()
+	}
+
 	return wc
 }
 
+// Stop terminates runCompactionReaper and runProgressNotify. It is safe
+// to call more than once, and safe to call even if progressNotifyInterval
+// is 0 (runProgressNotify was never started).
+func (w *watchCache) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopCh)
+	})
+}
+
+// deferCompaction records that rv's history couldn't be compacted yet
+// because a paginated LIST was still reading it. Assumes the watchCache
+// lock is already held for write (called from updateCache).
+func (w *watchCache) deferCompaction(rv uint64) {
+	w.pendingCompactionsLock.Lock()
+	defer w.pendingCompactionsLock.Unlock()
+	w.pendingCompactions = append(w.pendingCompactions, pendingCompaction{rv: rv, since: w.clock.Now()})
+}
+
+// runCompactionReaper retries compactions updateCache deferred because
+// continueCache reported the revision as pinned, forcing one through
+// once it's been pending for longer than maxDeferredCompactionAge so a
+// stuck or abandoned pagination can't hold history open forever.
+func (w *watchCache) runCompactionReaper() {
+	ticker := w.clock.NewTicker(compactionReaperInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			w.retryDeferredCompactions()
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+func (w *watchCache) retryDeferredCompactions() {
+	w.pendingCompactionsLock.Lock()
+	pending := w.pendingCompactions
+	w.pendingCompactions = nil
+	w.pendingCompactionsLock.Unlock()
+
+	var stillPending []pendingCompaction
+	for _, p := range pending {
+		if w.continueCache.isPinned(p.rv) && w.clock.Since(p.since) < maxDeferredCompactionAge {
+			stillPending = append(stillPending, p)
+			continue
+		}
+		if w.continueCache.isPinned(p.rv) {
+			klog.Warningf("forcing compaction of resource version %d after it was pinned for over %v", p.rv, maxDeferredCompactionAge)
+		}
+		w.continueCache.cleanup(p.rv)
+		w.store.Compact(int64(p.rv))
+	}
+
+	if len(stillPending) > 0 {
+		w.pendingCompactionsLock.Lock()
+		w.pendingCompactions = append(w.pendingCompactions, stillPending...)
+		w.pendingCompactionsLock.Unlock()
+	}
+}
+
 // Add takes runtime.Object as an argument.
 func (w *watchCache) Add(obj interface{}) error {
 	object, resourceVersion, err := w.objectToVersionedRuntimeObject(obj)
@@ -298,7 +435,7 @@ func (w *watchCache) processEvent(event watch.Event, resourceVersion uint64, upd
 	if err != nil {
 		return fmt.Errorf("couldn't compute key: %v", err)
 	}
-	elem := &storeElement{Key: key, Object: event.Object}
+	elem := &storeElement{Key: key, Object: event.Object, ResourceVersion: resourceVersion}
 	elem.Labels, elem.Fields, err = w.getAttrsFunc(event.Object)
 	if err != nil {
 		return err
@@ -357,7 +494,19 @@ func (w *watchCache) updateCache(event *watchCacheEvent) {
 	w.resizeCacheLocked(event.RecordTime)
 	if w.isCacheFullLocked() {
 		oldestRV := w.cache[w.startIndex%w.capacity].ResourceVersion
-		w.continueCache.cleanup(oldestRV)
+		// A paginated LIST may still be actively reading oldestRV's
+		// history; compacting it out from under that read would make a
+		// later page of the same LIST inconsistent with earlier ones.
+		// Defer to the reaper instead of blocking the reflector here.
+		// continueCache must only be invalidated once the compaction that
+		// makes oldestRV actually unreadable happens - invalidating it here
+		// unconditionally would 410 a pinned, still-servable continuation.
+		if w.continueCache.isPinned(oldestRV) {
+			w.deferCompaction(oldestRV)
+		} else {
+			w.continueCache.cleanup(oldestRV)
+			w.store.Compact(int64(oldestRV))
+		}
 		// Cache is full - remove the oldest element.
 		w.startIndex++
 	}
@@ -424,15 +573,71 @@ func (w *watchCache) UpdateResourceVersion(resourceVersion string) {
 	// This is safe as long as there is at most one call to Add/Update/Delete and
 	// UpdateResourceVersion in flight at any point in time, which is true now,
 	// because reflector calls them synchronously from its main thread.
+	w.notifyBookmark(rv)
+}
+
+// notifyBookmark sends a synthetic watch.Bookmark event at rv to the event
+// handler and records that a bookmark went out at this time, so a
+// subsequent progress-notify tick within progressNotifyInterval of it can
+// skip sending a redundant one. Must be called without the watchCache lock
+// held.
+func (w *watchCache) notifyBookmark(rv uint64) {
+	w.bookmarkLock.Lock()
+	w.lastBookmark = w.clock.Now()
+	w.bookmarkLock.Unlock()
+
 	if w.eventHandler != nil {
-		wcEvent := &watchCacheEvent{
+		w.eventHandler(&watchCacheEvent{
 			Type:            watch.Bookmark,
 			ResourceVersion: rv,
+		})
+	}
+}
+
+// runProgressNotify periodically sends a synthetic bookmark carrying the
+// current resourceVersion, so that a watcher blocked on a namespace with no
+// real writes to piggyback a bookmark on still sees resourceVersion
+// advance instead of stalling indefinitely.
+func (w *watchCache) runProgressNotify() {
+	ticker := w.clock.NewTicker(w.progressNotifyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			w.maybeNotifyProgress()
+		case <-w.stopCh:
+			return
 		}
-		w.eventHandler(wcEvent)
 	}
 }
 
+// maybeNotifyProgress sends a progress bookmark unless one has already
+// gone out, real or synthetic, within the last progressNotifyInterval.
+func (w *watchCache) maybeNotifyProgress() {
+	w.bookmarkLock.Lock()
+	due := w.clock.Since(w.lastBookmark) >= w.progressNotifyInterval
+	w.bookmarkLock.Unlock()
+	if !due {
+		return
+	}
+
+	w.RLock()
+	rv := w.resourceVersion
+	w.RUnlock()
+	w.notifyBookmark(rv)
+}
+
+// RequestWatchProgress forces an immediate progress bookmark at the
+// cache's current resourceVersion, bypassing the progressNotifyInterval
+// coalescing window. It's the entry point the cacher layer calls in
+// response to a client's explicit watch-progress request.
+func (w *watchCache) RequestWatchProgress() {
+	w.RLock()
+	rv := w.resourceVersion
+	w.RUnlock()
+	w.notifyBookmark(rv)
+}
+
 // List returns list of pointers to <storeElement> objects.
 func (w *watchCache) List() []interface{} {
 	return w.store.List()
@@ -487,71 +692,169 @@ func (w *watchCache) waitUntilFreshAndBlock(resourceVersion uint64, trace *utilt
 func (w *watchCache) WaitUntilFreshAndList(resourceVersion uint64, key string, listOpts storage.ListOptions, trace *utiltrace.Trace) ([]interface{}, uint64, string, error) {
 	err := w.waitUntilFreshAndBlock(resourceVersion, trace)
 	if err != nil {
+		w.RUnlock()
 		return nil, 0, "", err
 	}
 
 	pred := listOpts.Predicate
 	hasContinuation := len(pred.Continue) > 0
 	hasLimit := pred.Limit > 0
+	rv := w.resourceVersion
 
 	if !hasLimit {
-		return w.store.List(), w.resourceVersion, "", nil
+		items := w.store.List()
+		w.RUnlock()
+		return items, rv, "", nil
 	}
 
-	// Perform a clone under the lock, this should be a relatively
-	// inexpensive operation since the implementation of clone uses
-	// copy on write semantics. Once cloned, serve the list from the
-	// cloned copy to avoid building the response under a lock.
-	var storeClone btreeIndexer
-	if err := func() error {
-		defer w.RUnlock()
-		if hasContinuation {
-			if _, ok := w.continueCache.cache[resourceVersion]; !ok {
-				// We return a 410 Gone here for the following reason:
-				//
-				// Before the LIST request reaches the watchCache, we
-				// check if it should be delegated to etcd directly. In
-				// this check, we see if the request has a continuation,
-				// if it does, we check if the RV of the continuation
-				// token is still present in the watchCache or not, if
-				// it isn't then we let etcd serve the request.
-				//
-				// As and when events are removed from the watchCache
-				// (when it becomes full), we also check and evict the
-				// cached copy of the tree for the resource version whose
-				// event is going to be removed.
-				//
-				// Due to this, in case the cached clone is evicted, we
-				// return a 410 Gone similar to when a continue token
-				// expires. On receiving this error, the client can retry
-				// and on this retry, the check for delegation will route
-				// the request to etcd and things proceed accordingly.
-				return errors.NewResourceExpired(fmt.Sprintf("too old resource version: %d", resourceVersion))
-			}
-			storeClone = w.continueCache.cache[resourceVersion]
-			return nil
+	// The tree keeps a full per-key revision history (see keyIndex), so
+	// serving a page at resourceVersion is a plain filtered walk rather
+	// than a clone, and that walk doesn't need the watchCache lock held -
+	// it only needs resourceVersion's history to survive compaction for
+	// as long as the walk takes. Pin it before releasing the lock so
+	// updateCache can't compact it out from under us once the ring
+	// buffer slides past it, then do the actual walk unlocked.
+	if hasContinuation {
+		if !w.continueCache.isValid(resourceVersion) {
+			w.RUnlock()
+			// We return a 410 Gone here for the following reason:
+			//
+			// Before the LIST request reaches the watchCache, we
+			// check if it should be delegated to etcd directly. In
+			// this check, we see if the request has a continuation,
+			// if it does, we check if the RV of the continuation
+			// token is still present in the watchCache or not, if
+			// it isn't then we let etcd serve the request.
+			//
+			// As and when events are removed from the watchCache
+			// (when it becomes full), we also compact the tree and
+			// invalidate the resource version whose event is going
+			// to be removed.
+			//
+			// Due to this, in case the resource version was
+			// compacted away, we return a 410 Gone similar to when a
+			// continue token expires. On receiving this error, the
+			// client can retry and on this retry, the check for
+			// delegation will route the request to etcd and things
+			// proceed accordingly.
+			return nil, 0, "", apierrors.NewResourceExpired(fmt.Sprintf("too old resource version: %d", resourceVersion))
 		}
-		storeClone = w.store.Clone()
-		w.continueCache.cache[resourceVersion] = storeClone
+	} else {
+		w.continueCache.markValid(resourceVersion)
+	}
+	w.continueCache.pin(resourceVersion)
+	w.RUnlock()
+	defer w.continueCache.unpin(resourceVersion)
 
-		return nil
-	}(); err != nil {
+	items, indexName, err := w.listAt(resourceVersion, key, listOpts, hasContinuation)
+	if err != nil {
 		return nil, 0, "", err
 	}
+	return items, rv, indexName, nil
+}
+
+// WaitUntilFreshAndListAt returns a paginated, point-in-time list as of rv
+// without waiting for the cache's resourceVersion to reach rv first. It is
+// for callers that already know rv is a resourceVersion the watch cache
+// has served a list at before - typically fetching a later page of a LIST
+// whose first page came from WaitUntilFreshAndList - and so don't need its
+// freshness wait or the bookkeeping that marks a brand-new resourceVersion
+// valid for continuation.
+func (w *watchCache) WaitUntilFreshAndListAt(rv uint64, key string, listOpts storage.ListOptions) ([]interface{}, string, error) {
+	if !w.continueCache.isValid(rv) {
+		return nil, "", apierrors.NewResourceExpired(fmt.Sprintf("too old resource version: %d", rv))
+	}
+	w.continueCache.pin(rv)
+	defer w.continueCache.unpin(rv)
+
+	return w.listAt(rv, key, listOpts, len(listOpts.Predicate.Continue) > 0)
+}
 
+// listAt walks the store for a single page of a paginated LIST as of rv.
+// Callers must have already pinned rv with continueCache so compaction
+// can't race this walk.
+func (w *watchCache) listAt(rv uint64, key string, listOpts storage.ListOptions, hasContinuation bool) ([]interface{}, string, error) {
 	if !strings.HasSuffix(key, "/") {
 		key += "/"
 	}
 
+	pred := listOpts.Predicate
+	startKey := key
 	if hasContinuation {
-		continueKey, _, err := decodeContinue(pred.Continue, key)
+		continueKey, _, err := DecodeContinue(pred.Continue, key)
 		if err != nil {
-			return nil, 0, "", apierrors.NewBadRequest(fmt.Sprintf("invalid continue token: %v", err))
+			return nil, "", apierrors.NewBadRequest(fmt.Sprintf("invalid continue token: %v", err))
+		}
+		startKey = continueKey
+	}
+
+	if indexName, indexValue, ok := selectIndex(w.indexers, pred); ok {
+		items, err := w.store.LimitByIndexAndPrefix(indexName, indexValue, key, startKey, pred.Limit, int64(rv))
+		if err == nil {
+			w.indexUsage.recordHit()
+			return items, indexName, nil
 		}
-		key = continueKey
+		// The index couldn't serve this page (LimitByIndexAndPrefix only
+		// fails when the store has no indexer under indexName); fall back
+		// to the unindexed walk below rather than failing the whole LIST.
+		klog.V(4).Infof("index %s=%s could not serve list of %s, falling back: %v", indexName, indexValue, key, err)
 	}
+	w.indexUsage.recordMiss()
+
+	return w.store.LimitPrefixReadAt(pred.Limit, startKey, int64(rv)), "", nil
+}
+
+// indexUsageStats counts how often WaitUntilFreshAndList could serve a
+// LIST from an indexed posting list instead of a full prefix walk.
+type indexUsageStats struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func (s *indexUsageStats) recordHit()  { s.hits.Add(1) }
+func (s *indexUsageStats) recordMiss() { s.misses.Add(1) }
+
+// HitsAndMisses returns the current index hit/miss counts, for wiring
+// into metrics.
+func (s *indexUsageStats) HitsAndMisses() (hits, misses uint64) {
+	return s.hits.Load(), s.misses.Load()
+}
 
-	return storeClone.LimitPrefixRead(listOpts.Predicate.Limit, key), w.resourceVersion, "", nil
+// selectIndex looks for a single indexable equality term in pred's label
+// or field selector - e.g. a label selector pinning exactly one value, or
+// a field selector like spec.nodeName=X - that a registered indexer can
+// serve directly. indexName follows the same "l:"/"f:" prefix convention
+// storeElementIndexers' callers register label/field indexers under.
+func selectIndex(indexers cache.Indexers, pred storage.SelectionPredicate) (indexName, indexValue string, ok bool) {
+	if pred.Label != nil {
+		if reqs, selectable := pred.Label.Requirements(); selectable {
+			for _, r := range reqs {
+				if r.Operator() != selection.Equals && r.Operator() != selection.DoubleEquals {
+					continue
+				}
+				values := r.Values().List()
+				if len(values) != 1 {
+					continue
+				}
+				name := "l:" + r.Key()
+				if _, ok := indexers[name]; ok {
+					return name, values[0], true
+				}
+			}
+		}
+	}
+	if pred.Field != nil {
+		for _, r := range pred.Field.Requirements() {
+			if r.Operator != selection.Equals {
+				continue
+			}
+			name := "f:" + r.Field
+			if _, ok := indexers[name]; ok {
+				return name, r.Value, true
+			}
+		}
+	}
+	return "", "", false
 }
 
 // WaitUntilFreshAndGet returns a pointers to <storeElement> object.
@@ -610,11 +913,16 @@ func (w *watchCache) Replace(objs []interface{}, resourceVersion string) error {
 		if err != nil {
 			return err
 		}
+		objRV, err := w.versioner.ObjectResourceVersion(object)
+		if err != nil {
+			return err
+		}
 		toReplace = append(toReplace, &storeElement{
-			Key:    key,
-			Object: object,
-			Labels: objLabels,
-			Fields: objFields,
+			Key:             key,
+			Object:          object,
+			Labels:          objLabels,
+			Fields:          objFields,
+			ResourceVersion: objRV,
 		})
 	}
 
@@ -689,7 +997,7 @@ func (w *watchCache) getAllEventsSinceLocked(resourceVersion uint64) (*watchCach
 		return ci, nil
 	}
 	if resourceVersion < oldest-1 {
-		return nil, errors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", resourceVersion, oldest-1))
+		return nil, apierrors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", resourceVersion, oldest-1))
 	}
 
 	// Binary search the smallest index at which resourceVersion is greater than the given one.
@@ -723,57 +1031,508 @@ type continueToken struct {
 	StartKey        string `json:"start"`
 }
 
-// parseFrom transforms an encoded predicate from into a versioned struct.
-// TODO: return a typed error that instructs clients that they must relist
-func decodeContinue(continueValue, keyPrefix string) (fromKey string, rv int64, err error) {
-	data, err := base64.RawURLEncoding.DecodeString(continueValue)
+// Sentinel errors returned by DecodeContinue and getRVFromContinue.
+// Callers can test for a specific cause with errors.Is, or for "nothing
+// will make this token decodable, the client must relist" with
+// errors.Is(err, ErrMustRelist) alone.
+var (
+	// ErrInvalidStartRV indicates a continue token's encoded
+	// resourceVersion is missing or zero.
+	ErrInvalidStartRV = errors.New("incorrect encoded start resourceVersion")
+
+	// ErrEmptyStartKey indicates a continue token's encoded start key is
+	// empty.
+	ErrEmptyStartKey = errors.New("encoded start key is empty")
+
+	// ErrGenericInvalidKey indicates a continue token that failed to
+	// base64/JSON decode, or whose start key didn't pass the
+	// path-traversal check.
+	ErrGenericInvalidKey = errors.New("continue key is not valid")
+
+	// ErrUnrecognizedEncodedVersion indicates a continue token whose
+	// APIVersion this server doesn't know how to decode.
+	ErrUnrecognizedEncodedVersion = errors.New("server does not recognize this encoded version")
+
+	// ErrV1TokenRejected indicates a meta.k8s.io/v1 continue token was
+	// presented while HMAC signing is enabled. v1 tokens predate the
+	// signature field entirely, so accepting them would let a client
+	// route around verify by simply asking for the unsigned format -
+	// see decodeContinueV1.
+	ErrV1TokenRejected = errors.New("meta.k8s.io/v1 continue tokens are not accepted while continue token signing is enabled")
+
+	// ErrMustRelist wraps every error DecodeContinue and getRVFromContinue
+	// return for meta.k8s.io/v1 and meta.k8s.io/v2 tokens and for tokens
+	// that fail to decode or name an unregistered version: none of them
+	// are retryable with the same token, so a REST handler can test
+	// errors.Is(err, ErrMustRelist) once to decide whether to return a 410
+	// Gone instructing the client to relist, without needing to separately
+	// recognize each underlying cause. An error from a decoder added with
+	// RegisterContinueDecoder is returned as that decoder produced it.
+	ErrMustRelist = errors.New("the provided continue parameter is no longer valid, the client must relist without it")
+)
+
+// continueTokenV2 is the meta.k8s.io/v2 continue token shape. It carries
+// the same fields as continueToken plus Extra, a forward-compatible slot
+// version-specific features (a per-shard cursor, an HMAC signature, a
+// consistent-read snapshot ID) can populate without each needing its own
+// top-level JSON field and a v3 bump.
+type continueTokenV2 struct {
+	APIVersion      string            `json:"v"`
+	ResourceVersion int64             `json:"rv"`
+	StartKey        string            `json:"start"`
+	Extra           map[string]string `json:"extra,omitempty"`
+}
+
+// ContinueDecoderFunc decodes a continue token's raw (base64-decoded) JSON
+// payload into the key to resume listing from, the resourceVersion it was
+// issued at, and any version-specific extra fields it carried.
+type ContinueDecoderFunc func(data []byte, keyPrefix string) (fromKey string, rv int64, extra map[string]interface{}, err error)
+
+// ContinueEncoderFunc is the inverse of ContinueDecoderFunc: it renders a
+// resume key (relative to keyPrefix), a resourceVersion, and optional
+// extra fields into a token's raw JSON payload, before base64 encoding.
+type ContinueEncoderFunc func(keyPrefix, startKey string, rv int64, extra map[string]interface{}) ([]byte, error)
+
+var (
+	continueDecoders = map[string]ContinueDecoderFunc{}
+	continueEncoders = map[string]ContinueEncoderFunc{}
+)
+
+// RegisterContinueDecoder adds (or replaces) the decoder for a continue
+// token APIVersion, so DecodeContinue and getRVFromContinue can be taught
+// a new token version - or keep accepting an old one during a rolling
+// upgrade - without their dispatch growing a hardcoded case per version.
+func RegisterContinueDecoder(version string, fn ContinueDecoderFunc) {
+	continueDecoders[version] = fn
+}
+
+// RegisterContinueEncoder adds (or replaces) the encoder for a continue
+// token APIVersion, mirroring RegisterContinueDecoder for EncodeContinue.
+func RegisterContinueEncoder(version string, fn ContinueEncoderFunc) {
+	continueEncoders[version] = fn
+}
+
+func init() {
+	RegisterContinueDecoder("meta.k8s.io/v1", decodeContinueV1)
+	RegisterContinueDecoder("meta.k8s.io/v2", decodeContinueV2)
+	RegisterContinueEncoder("meta.k8s.io/v1", encodeContinueV1)
+	RegisterContinueEncoder("meta.k8s.io/v2", encodeContinueV2)
+}
+
+// DecodeContinue transforms an encoded continue token into the key to
+// resume listing from and the resourceVersion it was issued at, via
+// whichever decoder is registered for the token's encoded APIVersion. It
+// is exported so storage implementations other than this package's
+// btreeStore-backed cache - other Cacher-like caches, or non-etcd
+// storage.Interface drivers - can share this parsing instead of
+// reimplementing it.
+func DecodeContinue(continueValue, keyPrefix string) (fromKey string, rv int64, err error) {
+	data, version, err := decodeContinuePayload(continueValue)
+	if err != nil {
+		return "", 0, err
+	}
+	decode, ok := continueDecoders[version]
+	if !ok {
+		return "", 0, fmt.Errorf("%w: %w %q", ErrMustRelist, ErrUnrecognizedEncodedVersion, version)
+	}
+	fromKey, rv, _, err = decode(data, keyPrefix)
+	return fromKey, rv, err
+}
+
+// EncodeContinue renders a continue token of the given APIVersion for
+// resuming a LIST after startKey (an absolute key under keyPrefix) at
+// resourceVersion rv. extra carries any fields specific to that version's
+// decoder/encoder pair and may be nil (meta.k8s.io/v1 ignores it).
+func EncodeContinue(version, keyPrefix, startKey string, rv int64, extra map[string]interface{}) (string, error) {
+	encode, ok := continueEncoders[version]
+	if !ok {
+		return "", fmt.Errorf("cannot encode a continue token: unrecognized version %q", version)
+	}
+	data, err := encode(keyPrefix, startKey, rv, extra)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// ContinueTokenCodec encodes and decodes a storage.Interface's pagination
+// continue tokens. It exists so storage implementations other than this
+// package's btreeStore-backed cache - the etcd3 store, or a future
+// non-etcd driver - can produce and consume tokens compatible with this
+// package's pagination semantics by depending on this interface rather
+// than copying DecodeContinue/EncodeContinue's logic, or reaching into
+// the decoder/encoder registry directly.
+type ContinueTokenCodec interface {
+	// Encode renders a token for resuming a LIST under keyPrefix after
+	// startKey at resourceVersion rv.
+	Encode(keyPrefix, startKey string, rv int64) (string, error)
+	// Decode parses a token previously produced by Encode back into the
+	// key to resume from and the resourceVersion it was issued at.
+	Decode(token, keyPrefix string) (fromKey string, rv int64, err error)
+}
+
+// MetaV1Codec is the default ContinueTokenCodec: it produces and consumes
+// meta.k8s.io/v1 tokens via EncodeContinue/DecodeContinue.
+type MetaV1Codec struct{}
+
+var _ ContinueTokenCodec = MetaV1Codec{}
+
+// Encode implements ContinueTokenCodec.
+func (MetaV1Codec) Encode(keyPrefix, startKey string, rv int64) (string, error) {
+	return EncodeContinue("meta.k8s.io/v1", keyPrefix, startKey, rv, nil)
+}
+
+// Decode implements ContinueTokenCodec.
+func (MetaV1Codec) Decode(token, keyPrefix string) (fromKey string, rv int64, err error) {
+	return DecodeContinue(token, keyPrefix)
+}
+
+// ValidateContinue reports whether continueValue is a well-formed,
+// decodable continue token for keyPrefix, discarding the decoded key and
+// resourceVersion. It lets the REST layer reject a malformed or expired
+// token up front - returning a Status with reason Expired - before the
+// request ever reaches the storage layer.
+func ValidateContinue(continueValue, keyPrefix string) error {
+	_, _, err := DecodeContinue(continueValue, keyPrefix)
+	return err
+}
+
+// ContinueTokenInfo is the decoded shape of a continue token as exposed
+// by InspectContinue, for admission/audit logging that wants to record
+// what a token says without performing a full decode - which requires a
+// keyPrefix to join StartKey against, and which a token InspectContinue
+// can still describe may no longer pass.
+type ContinueTokenInfo struct {
+	APIVersion      string
+	ResourceVersion int64
+	// StartKey is the raw start key as encoded in the token, relative to
+	// whatever keyPrefix it will eventually be joined against by
+	// DecodeContinue - not an absolute key.
+	StartKey string
+}
+
+// continueTokenInfoShape is the JSON fields common to every continue
+// token version InspectContinue needs: newer versions may add fields
+// (like continueTokenV2's Extra), but all of them so far share this
+// envelope.
+type continueTokenInfoShape struct {
+	APIVersion      string `json:"v"`
+	ResourceVersion int64  `json:"rv"`
+	StartKey        string `json:"start"`
+}
+
+// InspectContinue peeks a continue token's APIVersion, resourceVersion,
+// and raw (unjoined) start key, without requiring a keyPrefix to resolve
+// StartKey against or verifying a v2 token's signature. Use DecodeContinue
+// to actually resolve and validate a token for serving a LIST.
+func InspectContinue(continueValue string) (ContinueTokenInfo, error) {
+	data, version, err := decodeContinuePayload(continueValue)
 	if err != nil {
-		return "", 0, fmt.Errorf("continue key is not valid: %v", err)
+		return ContinueTokenInfo{}, err
+	}
+	if _, ok := continueDecoders[version]; !ok {
+		return ContinueTokenInfo{}, fmt.Errorf("%w: %w %q", ErrMustRelist, ErrUnrecognizedEncodedVersion, version)
+	}
+	var c continueTokenInfoShape
+	if err := json.Unmarshal(data, &c); err != nil {
+		return ContinueTokenInfo{}, fmt.Errorf("%w: %w: %v", ErrMustRelist, ErrGenericInvalidKey, err)
+	}
+	return ContinueTokenInfo{
+		APIVersion:      c.APIVersion,
+		ResourceVersion: c.ResourceVersion,
+		StartKey:        c.StartKey,
+	}, nil
+}
+
+// decodeContinuePayload base64-decodes continueValue and peeks its
+// APIVersion field, without otherwise interpreting the payload - the
+// matching registered decoder does the rest.
+func decodeContinuePayload(continueValue string) (data []byte, version string, err error) {
+	data, err = base64.RawURLEncoding.DecodeString(continueValue)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w: %v", ErrMustRelist, ErrGenericInvalidKey, err)
+	}
+	var peek struct {
+		APIVersion string `json:"v"`
+	}
+	if err := json.Unmarshal(data, &peek); err != nil {
+		return nil, "", fmt.Errorf("%w: %w: %v", ErrMustRelist, ErrGenericInvalidKey, err)
+	}
+	return data, peek.APIVersion, nil
+}
+
+// cleanStartKey defends against path traversal attacks by clients -
+// path.Clean will ensure that startKey cannot be at a higher level of the
+// hierarchy, and so when we append the key prefix we will end up with a
+// continue start key that is fully qualified and cannot range over
+// anything less specific than keyPrefix.
+func cleanStartKey(keyPrefix, startKey string) (string, error) {
+	key := startKey
+	if !strings.HasPrefix(key, "/") {
+		key = "/" + key
+	}
+	cleaned := path.Clean(key)
+	if cleaned != key {
+		return "", fmt.Errorf("%w: %w: %s", ErrMustRelist, ErrGenericInvalidKey, startKey)
+	}
+	return keyPrefix + cleaned[1:], nil
+}
+
+// decodeContinueV1 has no signature field to verify: meta.k8s.io/v1
+// predates HMAC signing entirely. It stays registered so tokens issued
+// before an operator turns signing on keep working through a rolling
+// upgrade, but once currentContinueTokenSigner actually has keys
+// configured, accepting it unconditionally would let a client bypass
+// verify's signature check just by asking for the unsigned format - so
+// decoding is refused from that point on and the client must relist. This
+// includes tokens produced by MetaV1Codec, which always encodes
+// meta.k8s.io/v1.
+func decodeContinueV1(data []byte, keyPrefix string) (fromKey string, rv int64, extra map[string]interface{}, err error) {
+	if len(currentContinueTokenSigner.keys) > 0 {
+		return "", 0, nil, fmt.Errorf("%w: %w", ErrMustRelist, ErrV1TokenRejected)
 	}
 	var c continueToken
 	if err := json.Unmarshal(data, &c); err != nil {
-		return "", 0, fmt.Errorf("continue key is not valid: %v", err)
+		return "", 0, nil, fmt.Errorf("%w: %w: %v", ErrMustRelist, ErrGenericInvalidKey, err)
 	}
-	switch c.APIVersion {
-	case "meta.k8s.io/v1":
-		if c.ResourceVersion == 0 {
-			return "", 0, fmt.Errorf("continue key is not valid: incorrect encoded start resourceVersion (version meta.k8s.io/v1)")
-		}
-		if len(c.StartKey) == 0 {
-			return "", 0, fmt.Errorf("continue key is not valid: encoded start key empty (version meta.k8s.io/v1)")
+	if c.ResourceVersion == 0 {
+		return "", 0, nil, fmt.Errorf("%w: %w (version meta.k8s.io/v1)", ErrMustRelist, ErrInvalidStartRV)
+	}
+	if len(c.StartKey) == 0 {
+		return "", 0, nil, fmt.Errorf("%w: %w (version meta.k8s.io/v1)", ErrMustRelist, ErrEmptyStartKey)
+	}
+	fromKey, err = cleanStartKey(keyPrefix, c.StartKey)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return fromKey, c.ResourceVersion, nil, nil
+}
+
+func encodeContinueV1(keyPrefix, startKey string, rv int64, _ map[string]interface{}) ([]byte, error) {
+	return json.Marshal(continueToken{
+		APIVersion:      "meta.k8s.io/v1",
+		ResourceVersion: rv,
+		StartKey:        strings.TrimPrefix(startKey, keyPrefix),
+	})
+}
+
+func decodeContinueV2(data []byte, keyPrefix string) (fromKey string, rv int64, extra map[string]interface{}, err error) {
+	var c continueTokenV2
+	if err := json.Unmarshal(data, &c); err != nil {
+		return "", 0, nil, fmt.Errorf("%w: %w: %v", ErrMustRelist, ErrGenericInvalidKey, err)
+	}
+	if c.ResourceVersion == 0 {
+		return "", 0, nil, fmt.Errorf("%w: %w (version meta.k8s.io/v2)", ErrMustRelist, ErrInvalidStartRV)
+	}
+	if len(c.StartKey) == 0 {
+		return "", 0, nil, fmt.Errorf("%w: %w (version meta.k8s.io/v2)", ErrMustRelist, ErrEmptyStartKey)
+	}
+	if !currentContinueTokenSigner.verify(c.APIVersion, c.StartKey, c.ResourceVersion, c.Extra[continueTokenKidExtraKey], c.Extra[continueTokenSigExtraKey]) {
+		return "", 0, nil, fmt.Errorf("%w: %w: signature verification failed", ErrMustRelist, ErrGenericInvalidKey)
+	}
+	fromKey, err = cleanStartKey(keyPrefix, c.StartKey)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if len(c.Extra) > 0 {
+		extra = make(map[string]interface{}, len(c.Extra))
+		for k, v := range c.Extra {
+			if k == continueTokenSigExtraKey || k == continueTokenKidExtraKey {
+				continue
+			}
+			extra[k] = v
 		}
-		// defend against path traversal attacks by clients - path.Clean will ensure that startKey cannot
-		// be at a higher level of the hierarchy, and so when we append the key prefix we will end up with
-		// continue start key that is fully qualified and cannot range over anything less specific than
-		// keyPrefix.
-		key := c.StartKey
-		if !strings.HasPrefix(key, "/") {
-			key = "/" + key
+	}
+	return fromKey, c.ResourceVersion, extra, nil
+}
+
+func encodeContinueV2(keyPrefix, startKey string, rv int64, extra map[string]interface{}) ([]byte, error) {
+	relativeKey := strings.TrimPrefix(startKey, keyPrefix)
+	c := continueTokenV2{
+		APIVersion:      "meta.k8s.io/v2",
+		ResourceVersion: rv,
+		StartKey:        relativeKey,
+	}
+	if len(extra) > 0 {
+		c.Extra = make(map[string]string, len(extra))
+		for k, v := range extra {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("continue token v2: extra field %q must be a string, got %T", k, v)
+			}
+			c.Extra[k] = s
 		}
-		cleaned := path.Clean(key)
-		if cleaned != key {
-			return "", 0, fmt.Errorf("continue key is not valid: %s", c.StartKey)
+	}
+	sig, kid, err := currentContinueTokenSigner.sign(c.APIVersion, relativeKey, rv)
+	if err != nil {
+		return nil, err
+	}
+	if sig != "" {
+		if c.Extra == nil {
+			c.Extra = make(map[string]string, 2)
 		}
-		return keyPrefix + cleaned[1:], c.ResourceVersion, nil
-	default:
-		return "", 0, fmt.Errorf("continue key is not valid: server does not recognize this encoded version %q", c.APIVersion)
+		c.Extra[continueTokenSigExtraKey] = sig
+		c.Extra[continueTokenKidExtraKey] = kid
 	}
+	return json.Marshal(c)
 }
 
-func getRVFromContinue(continueValue string) (uint64, error) {
-	data, err := base64.RawURLEncoding.DecodeString(continueValue)
+// continueTokenSigExtraKey and continueTokenKidExtraKey are the Extra
+// fields a signed v2 token carries its HMAC signature and signing key ID
+// in. They're reserved: when signing is enabled, a caller-supplied extra
+// map that sets them is silently overwritten by encodeContinueV2 (in
+// nosign mode they are encoded as given), and decodeContinueV2 never
+// returns them in extra.
+const (
+	continueTokenSigExtraKey = "sig"
+	continueTokenKidExtraKey = "kid"
+)
+
+// continueTokenSigner signs and verifies the HMAC-SHA256 embedded in a v2
+// continue token's Extra map, over {APIVersion, ResourceVersion,
+// StartKey}. This closes an abuse vector where a client assembles its own
+// StartKey just under keyPrefix to probe list ordering or bypass
+// admission-selected ranges, by making the token unforgeable without one
+// of the server's keys.
+//
+// It supports multiple active keys, identified by an opaque key ID, so an
+// operator can rotate keys by adding a new one, waiting out in-flight
+// tokens' lifetime, then removing the old one - the same pattern as a JWT
+// kid.
+type continueTokenSigner struct {
+	// keys maps a key ID to its signing secret. A nil or empty keys is
+	// "nosign" mode: sign is a no-op and verify accepts anything,
+	// signed or not - needed for backward compatibility while an
+	// upgrade is rolling out and not every apiserver instance has been
+	// given a key yet. Going the other way, a non-empty keys is also
+	// what decodeContinueV1 checks to decide whether the rollout is far
+	// enough along to stop accepting the unsigned meta.k8s.io/v1 format.
+	keys map[string][]byte
+	// primary is the key ID sign uses to produce new tokens.
+	primary string
+}
+
+// nosignContinueTokenSigner is the default signer: no keys configured, so
+// it never signs and accepts any token regardless of signature.
+var nosignContinueTokenSigner = &continueTokenSigner{}
+
+// currentContinueTokenSigner is the signer encodeContinueV2/decodeContinueV2
+// use to sign and verify. SetContinueTokenSigningKeys reconfigures it.
+var currentContinueTokenSigner = nosignContinueTokenSigner
+
+// newContinueTokenSigner builds a signer from a set of named keys and the
+// key ID that should sign newly issued tokens. Passing no keys yields the
+// nosign signer.
+func newContinueTokenSigner(keys map[string][]byte, primary string) (*continueTokenSigner, error) {
+	if len(keys) == 0 {
+		return nosignContinueTokenSigner, nil
+	}
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("continue token signer: primary key id %q not present in supplied keys", primary)
+	}
+	return &continueTokenSigner{keys: keys, primary: primary}, nil
+}
+
+// SetContinueTokenSigningKeys configures HMAC signing for meta.k8s.io/v2
+// continue tokens from a set of named keys - as loaded from a
+// --continue-token-keys file, supporting multiple active keys for
+// rollover - and the key ID that should sign newly issued tokens. Passing
+// an empty keys map restores nosign mode.
+func SetContinueTokenSigningKeys(keys map[string][]byte, primaryKeyID string) error {
+	signer, err := newContinueTokenSigner(keys, primaryKeyID)
 	if err != nil {
-		return 0, fmt.Errorf("continue key is not valid: %v", err)
+		return err
 	}
+	currentContinueTokenSigner = signer
+	return nil
+}
 
-	var c continueToken
-	if err := json.Unmarshal(data, &c); err != nil {
-		return 0, fmt.Errorf("continue key is not valid: %v", err)
+// continueTokenKeyFileEntry is one entry of the JSON array a
+// --continue-token-keys file holds: a named HMAC key, base64-encoded.
+type continueTokenKeyFileEntry struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// LoadContinueTokenSigningKeys parses a --continue-token-keys file's
+// contents and installs the resulting keys via SetContinueTokenSigningKeys,
+// using the file's first entry as the primary (signing) key and every
+// entry as a valid verification key - so a key being rotated out can stay
+// listed, just not first, until every outstanding token signed with it has
+// expired.
+func LoadContinueTokenSigningKeys(data []byte) error {
+	var entries []continueTokenKeyFileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("continue token keys: %v", err)
+	}
+	if len(entries) == 0 {
+		return SetContinueTokenSigningKeys(nil, "")
 	}
+	keys := make(map[string][]byte, len(entries))
+	for _, e := range entries {
+		key, err := base64.StdEncoding.DecodeString(e.Key)
+		if err != nil {
+			return fmt.Errorf("continue token keys: key %q: %v", e.ID, err)
+		}
+		keys[e.ID] = key
+	}
+	return SetContinueTokenSigningKeys(keys, entries[0].ID)
+}
 
-	if c.APIVersion != "meta.k8s.io/v1" {
-		return 0, fmt.Errorf("continue key is not valid: server does not recognize this encoded version %q", c.APIVersion)
+// sign computes the HMAC-SHA256 over {version, rv, startKey} and returns
+// it base64-encoded alongside the key ID it was signed with. In nosign
+// mode it returns ("", "", nil) and the caller omits both from Extra.
+func (s *continueTokenSigner) sign(version, startKey string, rv int64) (sig, kid string, err error) {
+	if len(s.keys) == 0 {
+		return "", "", nil
 	}
+	key, ok := s.keys[s.primary]
+	if !ok {
+		return "", "", fmt.Errorf("continue token signer: primary key id %q not present in configured keys", s.primary)
+	}
+	mac := hmac.New(sha256.New, key)
+	writeSignedContinueFields(mac, version, startKey, rv)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), s.primary, nil
+}
 
-	return uint64(c.ResourceVersion), nil
+// verify reports whether sig is a valid HMAC-SHA256 over {version, rv,
+// startKey} under the key identified by kid. In nosign mode it always
+// succeeds, so tokens issued before signing was turned on keep working
+// through an upgrade.
+func (s *continueTokenSigner) verify(version, startKey string, rv int64, kid, sig string) bool {
+	if len(s.keys) == 0 {
+		return true
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	writeSignedContinueFields(mac, version, startKey, rv)
+	expected := mac.Sum(nil)
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expected, got)
+}
+
+func writeSignedContinueFields(mac hash.Hash, version, startKey string, rv int64) {
+	fmt.Fprintf(mac, "%s\x00%d\x00%s", version, rv, startKey)
+}
+
+func getRVFromContinue(continueValue string) (uint64, error) {
+	data, version, err := decodeContinuePayload(continueValue)
+	if err != nil {
+		return 0, err
+	}
+	decode, ok := continueDecoders[version]
+	if !ok {
+		return 0, fmt.Errorf("%w: %w %q", ErrMustRelist, ErrUnrecognizedEncodedVersion, version)
+	}
+	_, rv, _, err := decode(data, "")
+	if err != nil {
+		return 0, err
+	}
+	return uint64(rv), nil
 }
@@ -0,0 +1,678 @@
+/*
+Copyright 2024 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cacher
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/storage"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/clock"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+// newTestPod builds a minimal namespaced object with the given name,
+// resourceVersion and "app" label, good enough to drive a watchCache
+// through keyFunc/getAttrsFunc/versioner without depending on a real API
+// type.
+func newTestPod(name string, rv uint64, appLabel string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion("v1")
+	u.SetKind("Pod")
+	u.SetNamespace("ns")
+	u.SetName(name)
+	u.SetLabels(map[string]string{"app": appLabel})
+	u.SetResourceVersion(strconv.FormatUint(rv, 10))
+	return u
+}
+
+func testWatchCacheKeyFunc(obj runtime.Object) (string, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return "", err
+	}
+	return "/pods/" + accessor.GetNamespace() + "/" + accessor.GetName(), nil
+}
+
+func testWatchCacheGetAttrsFunc(obj runtime.Object) (labels.Set, fields.Set, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	return labels.Set(accessor.GetLabels()), fields.Set{"metadata.name": accessor.GetName()}, nil
+}
+
+// newTestWatchCache builds a watchCache over newTestPod objects, wired up
+// with testWatchCacheKeyFunc/testWatchCacheGetAttrsFunc and
+// storage.APIObjectVersioner{}, so tests only need to supply the indexers,
+// eventHandler and clock that are actually under test.
+func newTestWatchCache(indexers cache.Indexers, eventHandler func(*watchCacheEvent), clk clock.WithTicker) *watchCache {
+	return newWatchCache(
+		testWatchCacheKeyFunc,
+		eventHandler,
+		testWatchCacheGetAttrsFunc,
+		storage.APIObjectVersioner{},
+		&indexers,
+		clk,
+		10,
+		reflect.TypeOf(&unstructured.Unstructured{}),
+	)
+}
+
+func appLabelIndexFunc(obj interface{}) ([]string, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+	return []string{u.GetLabels()["app"]}, nil
+}
+
+func TestSelectIndex(t *testing.T) {
+	indexers := cache.Indexers{
+		"l:app":           appLabelIndexFunc,
+		"f:spec.nodeName": func(interface{}) ([]string, error) { return nil, nil },
+	}
+
+	tests := []struct {
+		name           string
+		pred           storage.SelectionPredicate
+		wantIndexName  string
+		wantIndexValue string
+		wantOK         bool
+	}{
+		{
+			name: "label equals term among several requirements is picked",
+			pred: storage.SelectionPredicate{
+				Label: labelSelectorOrDie(t, "app=foo,env in (prod,staging)"),
+			},
+			wantIndexName:  "l:app",
+			wantIndexValue: "foo",
+			wantOK:         true,
+		},
+		{
+			name: "multi-valued label requirement is not indexable",
+			pred: storage.SelectionPredicate{
+				Label: labelSelectorOrDie(t, "app in (foo,bar)"),
+			},
+			wantOK: false,
+		},
+		{
+			name: "field equals term is picked",
+			pred: storage.SelectionPredicate{
+				Field: fields.ParseSelectorOrDie("spec.nodeName=node-1"),
+			},
+			wantIndexName:  "f:spec.nodeName",
+			wantIndexValue: "node-1",
+			wantOK:         true,
+		},
+		{
+			name: "no registered indexer for the selector's term",
+			pred: storage.SelectionPredicate{
+				Field: fields.ParseSelectorOrDie("status.phase=Running"),
+			},
+			wantOK: false,
+		},
+		{
+			name:   "empty predicate",
+			pred:   storage.SelectionPredicate{},
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			indexName, indexValue, ok := selectIndex(indexers, tt.pred)
+			if ok != tt.wantOK {
+				t.Fatalf("selectIndex() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if indexName != tt.wantIndexName || indexValue != tt.wantIndexValue {
+				t.Fatalf("selectIndex() = (%q, %q), want (%q, %q)", indexName, indexValue, tt.wantIndexName, tt.wantIndexValue)
+			}
+		})
+	}
+}
+
+func labelSelectorOrDie(t *testing.T, s string) labels.Selector {
+	t.Helper()
+	sel, err := labels.Parse(s)
+	if err != nil {
+		t.Fatalf("labels.Parse(%q): %v", s, err)
+	}
+	return sel
+}
+
+// TestWatchCacheIndexedListSurvivesResize drives enough Add calls through a
+// watchCache to force its cyclic event buffer to grow past its initial
+// capacity (see resizeCacheLocked/doCacheResizeLocked), and checks that an
+// indexed LIST still returns exactly the matching set afterwards - i.e.
+// that growing/sliding the ring buffer doesn't disturb the underlying
+// indexed store it fronts.
+func TestWatchCacheIndexedListSurvivesResize(t *testing.T) {
+	indexers := cache.Indexers{"l:app": appLabelIndexFunc}
+	w := newTestWatchCache(indexers, nil, clock.RealClock{})
+	defer w.Stop()
+
+	const numObjects = 250
+	apps := []string{"foo", "bar", "baz"}
+	wantFoo := 0
+	for i := 0; i < numObjects; i++ {
+		app := apps[i%len(apps)]
+		if app == "foo" {
+			wantFoo++
+		}
+		if err := w.Add(newTestPod(fmt.Sprintf("pod-%d", i), uint64(i+1), app)); err != nil {
+			t.Fatalf("Add(pod-%d): %v", i, err)
+		}
+	}
+
+	w.RLock()
+	capacity := w.capacity
+	w.RUnlock()
+	if capacity <= defaultLowerBoundCapacity {
+		t.Fatalf("expected the cache to have grown past its lower bound capacity of %d, got %d", defaultLowerBoundCapacity, capacity)
+	}
+
+	pred := storage.SelectionPredicate{
+		Label: labels.SelectorFromSet(labels.Set{"app": "foo"}),
+		Limit: numObjects,
+	}
+	items, _, indexName, err := w.WaitUntilFreshAndList(uint64(numObjects), "/pods/ns/", storage.ListOptions{Predicate: pred}, nil)
+	if err != nil {
+		t.Fatalf("WaitUntilFreshAndList: %v", err)
+	}
+	if indexName != "l:app" {
+		t.Fatalf("expected the list to be served from index %q, got %q", "l:app", indexName)
+	}
+	if len(items) != wantFoo {
+		t.Fatalf("expected %d items with app=foo, got %d", wantFoo, len(items))
+	}
+	for _, item := range items {
+		elem := item.(*storeElement)
+		if elem.Labels["app"] != "foo" {
+			t.Fatalf("list returned non-matching element %q with app=%q", elem.Key, elem.Labels["app"])
+		}
+	}
+	if hits, _ := w.indexUsage.HitsAndMisses(); hits == 0 {
+		t.Fatalf("expected at least one indexed list hit")
+	}
+}
+
+// recvBookmark waits up to a few seconds of real time for a synthetic or
+// real bookmark to arrive on events - the clock driving watchCache is fake,
+// but runProgressNotify is a real goroutine, so delivery still needs a
+// real-time wait.
+func recvBookmark(t *testing.T, events <-chan *watchCacheEvent) *watchCacheEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.Type != watch.Bookmark {
+			t.Fatalf("expected a Bookmark event, got %v", e.Type)
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a bookmark")
+		return nil
+	}
+}
+
+// assertNoBookmark fails if a bookmark arrives within a short real-time
+// window, used to confirm a periodic tick was correctly suppressed.
+func assertNoBookmark(t *testing.T, events <-chan *watchCacheEvent) {
+	t.Helper()
+	select {
+	case e := <-events:
+		t.Fatalf("expected no bookmark, got %v at rv %d", e.Type, e.ResourceVersion)
+	case <-time.After(250 * time.Millisecond):
+	}
+}
+
+// waitForFakeClockWaiter polls until something has registered a waiter
+// (After/NewTicker) with fakeClock, so a test can be sure a background
+// goroutine has reached its clock.NewTicker call before advancing time.
+func waitForFakeClockWaiter(t *testing.T, fakeClock *testingclock.FakeClock) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !fakeClock.HasWaiters() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a background goroutine to register with the fake clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// runCompactionReaper and runProgressNotify both register a ticker;
+	// HasWaiters only promises at least one, so give the other a moment too.
+	time.Sleep(20 * time.Millisecond)
+}
+
+// TestWatchCacheProgressNotifyIdleNamespace exercises runProgressNotify end
+// to end with a fake clock: a watcher on a namespace with no real writes
+// should still see a synthetic bookmark within progressNotifyInterval, and
+// a real bookmark that lands between ticks should suppress the next
+// periodic one rather than sending a redundant heartbeat.
+func TestWatchCacheProgressNotifyIdleNamespace(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fakeClock := testingclock.NewFakeClock(base)
+
+	events := make(chan *watchCacheEvent, 8)
+	w := newTestWatchCache(cache.Indexers{}, func(e *watchCacheEvent) { events <- e }, fakeClock)
+	defer w.Stop()
+
+	// newWatchCache starts runCompactionReaper and runProgressNotify in
+	// their own goroutines; give them a moment to register their tickers
+	// with the fake clock before advancing it, or the first Step below
+	// could land before there's anything waiting on it.
+	waitForFakeClockWaiter(t, fakeClock)
+
+	// Idle: nothing is written, but the periodic heartbeat should still
+	// fire once progressNotifyInterval has elapsed.
+	fakeClock.Step(defaultProgressNotifyInterval)
+	if e := recvBookmark(t, events); e.ResourceVersion != 0 {
+		t.Fatalf("expected idle bookmark at rv 0, got %d", e.ResourceVersion)
+	}
+
+	// A real update 2 minutes later sends its own bookmark...
+	fakeClock.Step(2 * time.Minute)
+	w.UpdateResourceVersion("123")
+	if e := recvBookmark(t, events); e.ResourceVersion != 123 {
+		t.Fatalf("expected real bookmark at rv 123, got %d", e.ResourceVersion)
+	}
+
+	// ...so the next periodic tick, 3 minutes later (progressNotifyInterval
+	// since the first bookmark), lands only 3 minutes after the real one
+	// and should be coalesced away rather than sent again.
+	fakeClock.Step(3 * time.Minute)
+	assertNoBookmark(t, events)
+
+	// Once a full interval has passed since the real bookmark, the
+	// heartbeat should resume on the following tick.
+	fakeClock.Step(5 * time.Minute)
+	if e := recvBookmark(t, events); e.ResourceVersion != 123 {
+		t.Fatalf("expected resumed heartbeat at rv 123, got %d", e.ResourceVersion)
+	}
+}
+
+// encodeRawToken base64-encodes v's JSON encoding the same way a real
+// continue token is encoded, without going through EncodeContinue - so
+// tests can construct malformed tokens EncodeContinue itself would never
+// produce.
+func encodeRawToken(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// TestDecodeContinueTypedErrors checks that DecodeContinue fails with the
+// specific sentinel error describing what's wrong with a malformed token,
+// and that every one of them is wrapped in ErrMustRelist so a caller can
+// test for "this token will never work" with a single errors.Is check.
+func TestDecodeContinueTypedErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{
+			name:    "not valid base64",
+			token:   "!!!not-base64!!!",
+			wantErr: ErrGenericInvalidKey,
+		},
+		{
+			name:    "base64 of invalid JSON",
+			token:   base64.RawURLEncoding.EncodeToString([]byte("not json")),
+			wantErr: ErrGenericInvalidKey,
+		},
+		{
+			name:    "unrecognized encoded version",
+			token:   encodeRawToken(t, continueToken{APIVersion: "meta.k8s.io/v99", ResourceVersion: 1, StartKey: "a"}),
+			wantErr: ErrUnrecognizedEncodedVersion,
+		},
+		{
+			name:    "v1 token with zero resourceVersion",
+			token:   encodeRawToken(t, continueToken{APIVersion: "meta.k8s.io/v1", ResourceVersion: 0, StartKey: "a"}),
+			wantErr: ErrInvalidStartRV,
+		},
+		{
+			name:    "v1 token with empty start key",
+			token:   encodeRawToken(t, continueToken{APIVersion: "meta.k8s.io/v1", ResourceVersion: 1, StartKey: ""}),
+			wantErr: ErrEmptyStartKey,
+		},
+		{
+			name:    "v2 token with zero resourceVersion",
+			token:   encodeRawToken(t, continueTokenV2{APIVersion: "meta.k8s.io/v2", ResourceVersion: 0, StartKey: "a"}),
+			wantErr: ErrInvalidStartRV,
+		},
+		{
+			name:    "v2 token with empty start key",
+			token:   encodeRawToken(t, continueTokenV2{APIVersion: "meta.k8s.io/v2", ResourceVersion: 1, StartKey: ""}),
+			wantErr: ErrEmptyStartKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := DecodeContinue(tt.token, "/registry/pods/")
+			if err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected errors.Is(err, %v), got %v", tt.wantErr, err)
+			}
+			if !errors.Is(err, ErrMustRelist) {
+				t.Fatalf("expected errors.Is(err, ErrMustRelist), got %v", err)
+			}
+		})
+	}
+}
+
+// TestEncodeDecodeContinueRoundTrip checks that EncodeContinue/DecodeContinue
+// round-trip correctly through the registry RegisterContinueDecoder/
+// RegisterContinueEncoder populate, for both of the versions this package
+// ships (meta.k8s.io/v1 and meta.k8s.io/v2).
+func TestEncodeDecodeContinueRoundTrip(t *testing.T) {
+	const keyPrefix = "/registry/pods/"
+
+	for _, version := range []string{"meta.k8s.io/v1", "meta.k8s.io/v2"} {
+		t.Run(version, func(t *testing.T) {
+			token, err := EncodeContinue(version, keyPrefix, keyPrefix+"ns/pod-7", 42, nil)
+			if err != nil {
+				t.Fatalf("EncodeContinue: %v", err)
+			}
+			fromKey, rv, err := DecodeContinue(token, keyPrefix)
+			if err != nil {
+				t.Fatalf("DecodeContinue: %v", err)
+			}
+			if fromKey != keyPrefix+"ns/pod-7" {
+				t.Fatalf("fromKey = %q, want %q", fromKey, keyPrefix+"ns/pod-7")
+			}
+			if rv != 42 {
+				t.Fatalf("rv = %d, want 42", rv)
+			}
+		})
+	}
+}
+
+// TestRegisterContinueDecoderRollingUpgrade simulates teaching the registry
+// a brand-new token version - the scenario RegisterContinueDecoder/
+// RegisterContinueEncoder exist for, e.g. a rolling upgrade introducing
+// meta.k8s.io/v3 - and checks that DecodeContinue dispatches to it once
+// registered, without disturbing the existing meta.k8s.io/v1 registration.
+func TestRegisterContinueDecoderRollingUpgrade(t *testing.T) {
+	const version = "meta.k8s.io/vtest"
+	const keyPrefix = "/registry/pods/"
+
+	type testToken struct {
+		APIVersion      string `json:"v"`
+		ResourceVersion int64  `json:"rv"`
+		StartKey        string `json:"start"`
+	}
+
+	RegisterContinueEncoder(version, func(keyPrefix, startKey string, rv int64, _ map[string]interface{}) ([]byte, error) {
+		return json.Marshal(testToken{APIVersion: version, ResourceVersion: rv, StartKey: startKey})
+	})
+	RegisterContinueDecoder(version, func(data []byte, keyPrefix string) (string, int64, map[string]interface{}, error) {
+		var c testToken
+		if err := json.Unmarshal(data, &c); err != nil {
+			return "", 0, nil, err
+		}
+		return keyPrefix + c.StartKey, c.ResourceVersion, nil, nil
+	})
+
+	token, err := EncodeContinue(version, keyPrefix, "ns/pod-1", 7, nil)
+	if err != nil {
+		t.Fatalf("EncodeContinue: %v", err)
+	}
+	fromKey, rv, err := DecodeContinue(token, keyPrefix)
+	if err != nil {
+		t.Fatalf("DecodeContinue: %v", err)
+	}
+	if fromKey != keyPrefix+"ns/pod-1" || rv != 7 {
+		t.Fatalf("DecodeContinue() = (%q, %d), want (%q, 7)", fromKey, rv, keyPrefix+"ns/pod-1")
+	}
+
+	// The existing versions must still work.
+	v1Token, err := EncodeContinue("meta.k8s.io/v1", keyPrefix, "ns/pod-2", 8, nil)
+	if err != nil {
+		t.Fatalf("EncodeContinue(meta.k8s.io/v1): %v", err)
+	}
+	if _, _, err := DecodeContinue(v1Token, keyPrefix); err != nil {
+		t.Fatalf("DecodeContinue(meta.k8s.io/v1) after registering %q: %v", version, err)
+	}
+}
+
+// resetContinueTokenSigningKeys restores nosign mode at the end of a test
+// that calls SetContinueTokenSigningKeys, so the package-level
+// currentContinueTokenSigner doesn't leak into other tests.
+func resetContinueTokenSigningKeys(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() {
+		if err := SetContinueTokenSigningKeys(nil, ""); err != nil {
+			t.Fatalf("resetting continue token signing keys: %v", err)
+		}
+	})
+}
+
+// TestContinueTokenSigningKeyRotation covers signing a meta.k8s.io/v2
+// token, then rotating to a new primary signing key while the old one is
+// kept around for verification - the supported key-rotation flow
+// SetContinueTokenSigningKeys documents - and checks that a token signed
+// before the rotation still verifies, a token signed after it is signed
+// with the new key, and once the old key is dropped entirely the token
+// signed with it fails verification while the one signed with the new key
+// keeps working.
+func TestContinueTokenSigningKeyRotation(t *testing.T) {
+	resetContinueTokenSigningKeys(t)
+	const keyPrefix = "/registry/pods/"
+	keyA := []byte("key-a-0123456789abcdef")
+	keyB := []byte("key-b-fedcba9876543210")
+
+	if err := SetContinueTokenSigningKeys(map[string][]byte{"a": keyA}, "a"); err != nil {
+		t.Fatalf("SetContinueTokenSigningKeys(a): %v", err)
+	}
+	tokenA, err := EncodeContinue("meta.k8s.io/v2", keyPrefix, "ns/pod-1", 10, nil)
+	if err != nil {
+		t.Fatalf("EncodeContinue signed with key a: %v", err)
+	}
+	if _, _, err := DecodeContinue(tokenA, keyPrefix); err != nil {
+		t.Fatalf("DecodeContinue(tokenA) before rotation: %v", err)
+	}
+
+	// Rotate: add key b as primary, keep a around for verification only.
+	if err := SetContinueTokenSigningKeys(map[string][]byte{"a": keyA, "b": keyB}, "b"); err != nil {
+		t.Fatalf("SetContinueTokenSigningKeys(a, b): %v", err)
+	}
+	if _, _, err := DecodeContinue(tokenA, keyPrefix); err != nil {
+		t.Fatalf("DecodeContinue(tokenA) survive rollover: %v", err)
+	}
+	tokenB, err := EncodeContinue("meta.k8s.io/v2", keyPrefix, "ns/pod-2", 11, nil)
+	if err != nil {
+		t.Fatalf("EncodeContinue signed with key b: %v", err)
+	}
+	if _, _, err := DecodeContinue(tokenB, keyPrefix); err != nil {
+		t.Fatalf("DecodeContinue(tokenB): %v", err)
+	}
+
+	// Finish the rotation: drop key a. tokenA, signed with the now-removed
+	// key, must stop verifying; tokenB, signed with b, must keep working.
+	if err := SetContinueTokenSigningKeys(map[string][]byte{"b": keyB}, "b"); err != nil {
+		t.Fatalf("SetContinueTokenSigningKeys(b): %v", err)
+	}
+	if _, _, err := DecodeContinue(tokenA, keyPrefix); !errors.Is(err, ErrGenericInvalidKey) {
+		t.Fatalf("expected DecodeContinue(tokenA) to fail signature verification after key a was dropped, got %v", err)
+	}
+	if _, _, err := DecodeContinue(tokenB, keyPrefix); err != nil {
+		t.Fatalf("DecodeContinue(tokenB) after dropping key a: %v", err)
+	}
+}
+
+// TestDecodeContinueV1RejectedOnceSigningEnabled is a regression test for
+// decodeContinueV1's HMAC-bypass fix: meta.k8s.io/v1 tokens have no
+// signature field at all, so once signing keys are configured, decoding
+// one must fail rather than silently accepting an unsigned token a client
+// could forge.
+func TestDecodeContinueV1RejectedOnceSigningEnabled(t *testing.T) {
+	resetContinueTokenSigningKeys(t)
+	const keyPrefix = "/registry/pods/"
+
+	v1Token, err := EncodeContinue("meta.k8s.io/v1", keyPrefix, "ns/pod-1", 5, nil)
+	if err != nil {
+		t.Fatalf("EncodeContinue(meta.k8s.io/v1): %v", err)
+	}
+	if _, _, err := DecodeContinue(v1Token, keyPrefix); err != nil {
+		t.Fatalf("DecodeContinue(meta.k8s.io/v1) before signing is enabled: %v", err)
+	}
+
+	if err := SetContinueTokenSigningKeys(map[string][]byte{"a": []byte("0123456789abcdef")}, "a"); err != nil {
+		t.Fatalf("SetContinueTokenSigningKeys: %v", err)
+	}
+	_, _, err = DecodeContinue(v1Token, keyPrefix)
+	if !errors.Is(err, ErrV1TokenRejected) {
+		t.Fatalf("expected errors.Is(err, ErrV1TokenRejected) once signing is enabled, got %v", err)
+	}
+	if !errors.Is(err, ErrMustRelist) {
+		t.Fatalf("expected errors.Is(err, ErrMustRelist), got %v", err)
+	}
+}
+
+// TestMetaV1CodecRoundTrip checks that MetaV1Codec's Encode/Decode pair
+// round-trip through ContinueTokenCodec, for storage implementations that
+// depend on the interface rather than calling EncodeContinue/DecodeContinue
+// directly.
+func TestMetaV1CodecRoundTrip(t *testing.T) {
+	const keyPrefix = "/registry/pods/"
+	var codec ContinueTokenCodec = MetaV1Codec{}
+
+	token, err := codec.Encode(keyPrefix, keyPrefix+"ns/pod-3", 99)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	fromKey, rv, err := codec.Decode(token, keyPrefix)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if fromKey != keyPrefix+"ns/pod-3" {
+		t.Fatalf("fromKey = %q, want %q", fromKey, keyPrefix+"ns/pod-3")
+	}
+	if rv != 99 {
+		t.Fatalf("rv = %d, want 99", rv)
+	}
+
+	// MetaV1Codec always produces meta.k8s.io/v1 tokens, regardless of
+	// whatever the registry's other versions look like.
+	info, err := InspectContinue(token)
+	if err != nil {
+		t.Fatalf("InspectContinue: %v", err)
+	}
+	if info.APIVersion != "meta.k8s.io/v1" {
+		t.Fatalf("APIVersion = %q, want meta.k8s.io/v1", info.APIVersion)
+	}
+}
+
+// TestValidateContinue checks that ValidateContinue accepts a well-formed
+// token and rejects a malformed one with the same error DecodeContinue
+// would have returned, without it needing to separately decode the result.
+func TestValidateContinue(t *testing.T) {
+	const keyPrefix = "/registry/pods/"
+
+	token, err := EncodeContinue("meta.k8s.io/v1", keyPrefix, keyPrefix+"ns/pod-1", 3, nil)
+	if err != nil {
+		t.Fatalf("EncodeContinue: %v", err)
+	}
+	if err := ValidateContinue(token, keyPrefix); err != nil {
+		t.Fatalf("ValidateContinue(valid token): %v", err)
+	}
+
+	expired := encodeRawToken(t, continueToken{APIVersion: "meta.k8s.io/v1", ResourceVersion: 0, StartKey: "ns/pod-1"})
+	err = ValidateContinue(expired, keyPrefix)
+	if !errors.Is(err, ErrInvalidStartRV) || !errors.Is(err, ErrMustRelist) {
+		t.Fatalf("ValidateContinue(malformed token) = %v, want errors wrapping ErrInvalidStartRV and ErrMustRelist", err)
+	}
+}
+
+// TestInspectContinue checks that InspectContinue peeks a token's
+// APIVersion, resourceVersion and raw start key without a keyPrefix to
+// join against or a valid v2 signature - unlike DecodeContinue, it's meant
+// to describe a token admission/audit logging can log even when the token
+// itself would no longer pass verification.
+func TestInspectContinue(t *testing.T) {
+	resetContinueTokenSigningKeys(t)
+
+	if err := SetContinueTokenSigningKeys(map[string][]byte{"a": []byte("0123456789abcdef")}, "a"); err != nil {
+		t.Fatalf("SetContinueTokenSigningKeys: %v", err)
+	}
+	token, err := EncodeContinue("meta.k8s.io/v2", "/registry/pods/", "/registry/pods/ns/pod-1", 17, nil)
+	if err != nil {
+		t.Fatalf("EncodeContinue: %v", err)
+	}
+
+	// Tamper with the signature so the token would fail DecodeContinue,
+	// but InspectContinue - which never checks it - should still describe
+	// it accurately.
+	tampered := tamperContinueTokenSignature(t, token)
+
+	info, err := InspectContinue(tampered)
+	if err != nil {
+		t.Fatalf("InspectContinue(tampered token): %v", err)
+	}
+	if info.APIVersion != "meta.k8s.io/v2" {
+		t.Fatalf("APIVersion = %q, want meta.k8s.io/v2", info.APIVersion)
+	}
+	if info.ResourceVersion != 17 {
+		t.Fatalf("ResourceVersion = %d, want 17", info.ResourceVersion)
+	}
+	if info.StartKey != "ns/pod-1" {
+		t.Fatalf("StartKey = %q, want %q", info.StartKey, "ns/pod-1")
+	}
+
+	if _, _, err := DecodeContinue(tampered, "/registry/pods/"); err == nil {
+		t.Fatal("expected DecodeContinue to reject the tampered signature InspectContinue ignored")
+	}
+}
+
+// tamperContinueTokenSignature flips the signature on a signed v2 token so
+// it fails verification, while leaving every other field - including its
+// structure - intact.
+func tamperContinueTokenSignature(t *testing.T, token string) string {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatalf("base64 decode: %v", err)
+	}
+	var c continueTokenV2
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatalf("json unmarshal: %v", err)
+	}
+	c.Extra[continueTokenSigExtraKey] = "not-a-valid-signature"
+	return encodeRawToken(t, c)
+}